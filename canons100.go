@@ -42,38 +42,51 @@ func checkExifFields(metadata []*jason.Object) (bool, int) {
 	return hasRatings, year
 }
 
-func mapCanonS100(imageinfo []*jason.Object) string {
+// Return the category for a camera that can only be identified from other
+// Exif fields, given the special case category that its make and model
+// were mapped to, or the mapped category if it isn't a special case.
+func mapSpecialCase(catMapped string, imageinfo []*jason.Object, site *site) string {
+	switch catMapped {
+	case site.category("CanonS100 (special case)"):
+		return mapCanonS100(imageinfo, site)
+	case site.category("CanonS110 (special case)"):
+		return mapCanonS110(imageinfo, site)
+	}
+	return catMapped
+}
+
+func mapCanonS100(imageinfo []*jason.Object, site *site) string {
 	metadata, err := imageinfo[0].GetObjectArray("commonmetadata")
 	if err != nil {
 		panic(err)
 	}
 	hasRatings, year := checkExifFields(metadata)
 	if hasRatings {
-		return "Category:Taken with Canon PowerShot S100"
+		return site.target("Canon PowerShot S100")
 	} else {
 		if year == 0 || year > 2010 {
 			// May be PowerShot S100 (released in 2011) with missing Exif fields.
-			return "Category:Taken with unidentified Canon PowerShot S100"
+			return site.target("unidentified Canon PowerShot S100")
 		} else {
-			return "Category:Taken with Canon Digital IXUS"
+			return site.target("Canon Digital IXUS")
 		}
 	}
 }
 
-func mapCanonS110(imageinfo []*jason.Object) string {
+func mapCanonS110(imageinfo []*jason.Object, site *site) string {
 	metadata, err := imageinfo[0].GetObjectArray("commonmetadata")
 	if err != nil {
 		panic(err)
 	}
 	hasRatings, year := checkExifFields(metadata)
 	if hasRatings {
-		return "Category:Taken with Canon PowerShot S110"
+		return site.target("Canon PowerShot S110")
 	} else {
 		if year == 0 || year > 2011 {
 			// May be PowerShot S110 (released in 2012) with missing Exif fields.
-			return "Category:Taken with unidentified Canon PowerShot S110"
+			return site.target("unidentified Canon PowerShot S110")
 		} else {
-			return "Category:Taken with Canon Digital IXUS v"
+			return site.target("Canon Digital IXUS v")
 		}
 	}
 }
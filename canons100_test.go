@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCanonS100LocalPrefixes(t *testing.T) {
+	wiki := newFakeWiki(t)
+	wiki.catName = "Kategorie"
+	wiki.addPage("Kategorie:Aufgenommen mit Canon PowerShot S100", "")
+	wiki.addPage("Kategorie:Aufgenommen mit Canon Digital IXUS", "")
+	s100 := wiki.addFile("File:S100.jpg", "Alice", "20190101000000", "Canon", "Canon PowerShot S100", "Eine Katze.")
+	s100.metadata = append(s100.metadata, []string{"ISOSpeedRatings", "100"})
+	ixus := wiki.addFile("File:IXUS.jpg", "Alice", "20190102000000", "Canon", "Canon PowerShot S100", "Ein Hund.")
+	ixus.metadata = append(ixus.metadata, []string{"DateTimeOriginal", "2005:06:01 12:00:00"})
+	local := writeTestFile(t, t.TempDir(), "local", "Canon,Canon PowerShot S100,Category:CanonS100 (special case)\n")
+	state := runTestCommand(t, wiki, []string{"User:Alice"}, "--localmappingfile", local, "--targetprefix", "Aufgenommen mit ", "--catfilelimit", "0")
+
+	// The special case is recognised with the Wiki's category prefix, and
+	// the categories it gives use the configured target prefix.
+	checkStats(t, state.stats, stats{examined: 2, withCamera: 2, warnings: 2, edited: 2})
+	checkText(t, wiki, "File:S100.jpg", "Eine Katze.\n[[Kategorie:Aufgenommen mit Canon PowerShot S100]]")
+	checkText(t, wiki, "File:IXUS.jpg", "Ein Hund.\n[[Kategorie:Aufgenommen mit Canon Digital IXUS]]")
+}
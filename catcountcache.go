@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Version of the category count file format.
+const catCountVersion = 1
+
+// Categories with at least farAboveFactor times CatFileLimit files are
+// refreshed farAboveFactor times less often, since the bot won't add to
+// them whatever their exact size.
+const farAboveFactor = 10
+
+type catCountStore struct {
+	Version    int                      `json:"version"`
+	Categories map[string]catCountEntry `json:"categories"`
+}
+
+type catCountEntry struct {
+	Files   int32     `json:"files"`
+	Exists  bool      `json:"exists"`
+	Fetched time.Time `json:"fetched"` // When the count was fetched from the Wiki.
+}
+
+// Category file counts and existence saved between runs. Entries are used
+// until they are older than the TTL, and are updated as the bot adds files.
+type catCountCache struct {
+	path    string
+	ttl     time.Duration
+	limit   int32 // CatFileLimit.
+	mutex   sync.Mutex
+	entries map[string]catCountEntry
+	dirty   bool
+	saved   time.Time
+}
+
+// Read the category count file, if it exists. Returns nil if path is blank.
+func readCatCountCache(path string, ttl time.Duration, limit int32) (*catCountCache, error) {
+	if path == "" {
+		return nil, nil
+	}
+	var store catCountStore
+	found, err := readJSONFile(path, &store)
+	if err != nil {
+		return nil, err
+	}
+	if found && store.Version != catCountVersion {
+		warn.Printf("%s: ignoring category count file version %d", path, store.Version)
+		store.Categories = nil
+	}
+	if store.Categories == nil {
+		store.Categories = make(map[string]catCountEntry)
+	}
+	return &catCountCache{path: path, ttl: ttl, limit: limit, entries: store.Categories, saved: time.Now()}, nil
+}
+
+// Return the entry for a category if it's fresh enough to use.
+func (c *catCountCache) lookup(category string) (catCountEntry, bool) {
+	if c == nil {
+		return catCountEntry{}, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, found := c.entries[category]
+	if !found {
+		return entry, false
+	}
+	ttl := c.ttl
+	if c.limit > 0 && entry.Files >= farAboveFactor*c.limit {
+		ttl *= farAboveFactor
+	}
+	return entry, time.Since(entry.Fetched) < ttl
+}
+
+// Save a count fetched from the Wiki, or record that the category doesn't
+// exist.
+func (c *catCountCache) store(category string, files int32, exists bool) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[category] = catCountEntry{files, exists, time.Now()}
+	c.dirty = true
+}
+
+// Record that a file has been added to a category.
+func (c *catCountCache) inc(category string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if entry, found := c.entries[category]; found {
+		entry.Files++
+		c.entries[category] = entry
+		c.dirty = true
+	}
+}
+
+// Save the category count file if it changed since it was last saved.
+func (c *catCountCache) save() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.dirty {
+		return
+	}
+	if err := writeJSONFile(c.path, catCountStore{catCountVersion, c.entries}); err != nil {
+		warn.Print("Can't save category counts: ", err)
+		return
+	}
+	c.dirty = false
+	c.saved = time.Now()
+}
+
+// Save the category count file if it's been a while.
+func (c *catCountCache) saveIfDue() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	due := time.Since(c.saved) >= cacheSaveInterval
+	c.mutex.Unlock()
+	if due {
+		c.save()
+	}
+}
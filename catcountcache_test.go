@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCatCountCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "catcounts")
+	cache, err := readCatCountCache(path, time.Hour, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.store("Category:Small", 5, true)
+	cache.store("Category:Missing", 0, false)
+	cache.inc("Category:Small")
+	cache.inc("Category:Unknown")
+	cache.entries["Category:Large"] = catCountEntry{farAboveFactor * 100, true, time.Now().Add(-2 * time.Hour)}
+	cache.entries["Category:Old"] = catCountEntry{farAboveFactor*100 - 1, true, time.Now().Add(-2 * time.Hour)}
+	cache.dirty = true
+	cache.save()
+
+	// Categories far above the limit stay fresh for longer.
+	cache, err = readCatCountCache(path, time.Hour, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		category string
+		files    int32
+		exists   bool
+		fresh    bool
+	}{
+		{"Category:Small", 6, true, true},
+		{"Category:Missing", 0, false, true},
+		{"Category:Large", farAboveFactor * 100, true, true},
+		{"Category:Old", farAboveFactor*100 - 1, true, false},
+		{"Category:Unknown", 0, false, false},
+	}
+	for _, test := range tests {
+		entry, fresh := cache.lookup(test.category)
+		if entry.Files != test.files || entry.Exists != test.exists || fresh != test.fresh {
+			t.Errorf("%s: got %+v, %v, want %d, %v, %v", test.category, entry, fresh, test.files, test.exists, test.fresh)
+		}
+	}
+
+	// Without a limit the TTL isn't extended.
+	cache, err = readCatCountCache(path, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, fresh := cache.lookup("Category:Large"); fresh {
+		t.Error("large category fresh without a limit")
+	}
+
+	// Files from another version of the format are ignored.
+	other := writeTestFile(t, t.TempDir(), "catcounts", `{"version":2,"categories":{"Category:Small":{"files":5,"exists":true,"fetched":"2100-01-01T00:00:00Z"}}}`)
+	if cache, err := readCatCountCache(other, time.Hour, 100); err != nil || len(cache.entries) != 0 {
+		t.Errorf("newer version used: %v", err)
+	}
+}
+
+func TestCatCountFile(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	counts := filepath.Join(t.TempDir(), "catcounts")
+	run := []string{"User:Alice"}
+	runTestCommand(t, wiki, run, "--catcountfile", counts)
+	lookups := wiki.props["categoryinfo"]
+	if lookups == 0 {
+		t.Fatal("no categoryinfo lookups")
+	}
+
+	// The counts, including the file added by the bot and the missing
+	// category, are used by the next run.
+	state := runTestCommand(t, wiki, run, "--catcountfile", counts, "--catfilelimit", "4")
+	if wiki.props["categoryinfo"] != lookups {
+		t.Errorf("categoryinfo looked up again")
+	}
+	if count, _ := state.catCountCache.lookup("Category:Taken with Canon EOS 5D"); count.Files != 4 {
+		t.Errorf("got count %d, want 4", count.Files)
+	}
+	if entry, fresh := state.catCountCache.lookup("Category:Taken with Foo cameras"); !fresh || entry.Exists {
+		t.Errorf("missing category not cached: %+v", entry)
+	}
+
+	// Expired entries are fetched again.
+	runTestCommand(t, wiki, run, "--catcountfile", counts, "--catcountttl", "0s")
+	if wiki.props["categoryinfo"] == lookups {
+		t.Errorf("expired categoryinfo not looked up")
+	}
+}
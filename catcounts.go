@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+)
+
+// Number of files in each category, shared between the lookup and edit
+// stages of the processing pipeline, and backed by the category count file
+// if there is one.
+type catCounts struct {
+	mutex  sync.Mutex
+	counts map[string]int32
+	cache  *catCountCache
+}
+
+func newCatCounts(cache *catCountCache) *catCounts {
+	return &catCounts{counts: make(map[string]int32), cache: cache}
+}
+
+// Return the cached count for a category, and whether it was found.
+func (c *catCounts) get(category string) (int32, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	count, found := c.counts[category]
+	if !found {
+		if entry, fresh := c.cache.lookup(category); fresh && entry.Exists {
+			count, found = entry.Files, true
+			c.counts[category] = count
+		}
+	}
+	return count, found
+}
+
+// Return true if the category's count or existence needs to be fetched
+// from the Wiki.
+func (c *catCounts) needed(category string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, found := c.counts[category]; found {
+		return false
+	}
+	_, fresh := c.cache.lookup(category)
+	return !fresh
+}
+
+// Cache a count fetched from the Wiki. An existing entry is kept, since it
+// may already include files added by the bot.
+func (c *catCounts) add(category string, count int32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, found := c.counts[category]; !found {
+		c.counts[category] = count
+		c.cache.store(category, count, true)
+	}
+}
+
+// Record that a category was found not to exist.
+func (c *catCounts) addMissing(category string) {
+	c.cache.store(category, 0, false)
+}
+
+// Record that a file has been added to a category.
+func (c *catCounts) inc(category string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.counts[category] = c.counts[category] + 1
+	c.cache.inc(category)
+}
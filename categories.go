@@ -1,71 +1,76 @@
 package main
 
 import (
-	mwclient "cgt.name/pkg/go-mwclient"
 	"cgt.name/pkg/go-mwclient/params"
-	"fmt"
-	"github.com/antonholmquist/jason"
 	"github.com/garyhouston/takenwith/mwlib"
 )
 
-func requestCategories(page string, client *mwclient.Client) *jason.Object {
-	params := params.Values{
-		"action":  "query",
-		"titles":  page,
-		"prop":    "categories",
-		"cllimit": "max",
-	}
-	json, err := client.Get(params)
-	if err != nil {
-		panic(err)
-	}
-	return json
-}
-
 // Given an array of page titles, return a mapping from page title to the array
 // of categories which the page is a member of.
 // If the page doesn't exist, or has no categories, it will map to nil.
-func getPageCategories(pages []string, client *mwclient.Client) map[string][]string {
-	params := params.Values{
-		"action":   "query",
-		"titles":   mwlib.MakeTitleString(pages),
-		"prop":     "categories",
-		"cllimit":  "max",
-		"continue": "",
-	}
-	json, err := client.Post(params) // Get may fail on long queries.
-	if err != nil {
-		fmt.Println(params)
-		panic(err)
-	}
-	pagesArray, err := json.GetObjectArray("query", "pages")
-	if err != nil {
-		panic(err)
-	}
+// The result is keyed by the titles as given, even if the Wiki normalises
+// them or they are redirects, in which case the target's categories are
+// returned. The titles are requested in chunks of at most titleLimit.
+func getPageCategories(pages []string, client wiki, titleLimit int) map[string][]string {
 	result := make(map[string][]string)
-	for _, page := range pagesArray {
-		pageObj, err := page.Object()
-		if err != nil {
-			panic(err)
-		}
-		title, err := pageObj.GetString("title")
-		if err != nil {
-			panic(err)
+	for start := 0; start < len(pages); start += titleLimit {
+		end := start + titleLimit
+		if end > len(pages) {
+			end = len(pages)
 		}
-		categories, err := pageObj.GetObjectArray("categories")
-		if err != nil {
-			// Presumably the page is deleted or has no categories.
-			result[title] = nil
-			continue
+		params := params.Values{
+			"titles":    mwlib.MakeTitleString(pages[start:end]),
+			"prop":      "categories",
+			"cllimit":   "max",
+			"redirects": "",
 		}
-		catArray := make([]string, len(categories))
-		for i := range categories {
-			catArray[i], err = categories[i].GetString("title")
+		// Post, since Get may fail on long queries.
+		query := newPostQuery(client, params)
+		for query.Next() {
+			requested := requestedTitles(query.Resp(), pages[start:end])
+			pagesArray, err := query.Resp().GetObjectArray("query", "pages")
 			if err != nil {
 				panic(err)
 			}
+			for _, page := range pagesArray {
+				pageObj, err := page.Object()
+				if err != nil {
+					panic(err)
+				}
+				title, err := pageObj.GetString("title")
+				if err != nil {
+					panic(err)
+				}
+				titles := requested[title]
+				if titles == nil {
+					titles = []string{title}
+				}
+				categories, err := pageObj.GetObjectArray("categories")
+				if err != nil {
+					// Presumably the page is deleted or has no
+					// categories, or they were all in another
+					// part of the results.
+					for _, title := range titles {
+						if _, found := result[title]; !found {
+							result[title] = nil
+						}
+					}
+					continue
+				}
+				for i := range categories {
+					category, err := categories[i].GetString("title")
+					if err != nil {
+						panic(err)
+					}
+					for _, title := range titles {
+						result[title] = append(result[title], category)
+					}
+				}
+			}
+		}
+		if query.Err() != nil {
+			panic(query.Err())
 		}
-		result[title] = catArray
 	}
 	return result
 }
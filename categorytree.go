@@ -0,0 +1,178 @@
+package main
+
+import (
+	"cgt.name/pkg/go-mwclient/params"
+	"github.com/antonholmquist/jason"
+	"regexp"
+	"strconv"
+)
+
+// A category found while walking a category tree, with its depth below
+// the starting category.
+type treeCategory struct {
+	title string
+	depth int
+}
+
+// Filter for the subcategories walked into.
+type categoryFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func newCategoryFilter(include, exclude []string) (*categoryFilter, error) {
+	var filter categoryFilter
+	for _, pattern := range include {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filter.include = append(filter.include, regex)
+	}
+	for _, pattern := range exclude {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filter.exclude = append(filter.exclude, regex)
+	}
+	return &filter, nil
+}
+
+// Return true if a category name, without the namespace prefix, matches
+// none of the exclude patterns and, if there are any, one of the include
+// patterns.
+func (f *categoryFilter) allows(name string) bool {
+	for _, regex := range f.exclude {
+		if regex.MatchString(name) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, regex := range f.include {
+		if regex.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Process the files in a category and its subcategories down to Depth
+// levels below it, with one warning gallery and set of category counts for
+// the whole tree.
+func processCategoryTree(category string, start, end timestamp, state *state) {
+	filter, err := newCategoryFilter(state.flags.IncludeCategory, state.flags.ExcludeCategory)
+	if err != nil {
+		warn.Print(err)
+		return
+	}
+	processSource(categoryTreeSource(category, start, end, filter, state), state.flags.FileLimit, state)
+}
+
+// Return a source of the titles of the files in a category and its
+// subcategories down to Depth levels below it, breadth first, a page of
+// members at a time. A category is walked once even if the tree has cycles,
+// and a file in several of the categories is returned once. Files are
+// limited to those added between start and end if they are valid.
+func categoryTreeSource(category string, start, end timestamp, filter *categoryFilter, state *state) titleSource {
+	root := state.site.category(category)
+	queue := []treeCategory{{root, 0}}
+	walked := map[string]bool{root: true}
+	found := make(map[string]bool) // File titles.
+	var query *query
+	return func(<-chan struct{}) ([]string, func(), bool) {
+		for {
+			if query == nil {
+				if len(queue) == 0 {
+					return nil, nil, false
+				}
+				current := queue[0]
+				queue = queue[1:]
+				state.verbose.Print("Listing ", current.title)
+				query = categoryFilesQuery(current.title, start, end, state)
+				if current.depth < state.flags.Depth {
+					for _, sub := range subcategories(current.title, state) {
+						name, _ := trimNamespace(sub, state.site.categoryPrefixes)
+						if walked[sub] || !filter.allows(name) {
+							continue
+						}
+						walked[sub] = true
+						queue = append(queue, treeCategory{sub, current.depth + 1})
+					}
+				}
+			}
+			if query.Next() {
+				var titles []string
+				for _, title := range memberTitles(query.Resp()) {
+					if !found[title] {
+						titles = append(titles, title)
+						found[title] = true
+					}
+				}
+				if len(titles) > 0 {
+					return titles, nil, true
+				}
+				continue
+			}
+			if query.Err() != nil {
+				panic(query.Err())
+			}
+			query = nil
+		}
+	}
+}
+
+// Return a query for the files in one category.
+func categoryFilesQuery(category string, start, end timestamp, state *state) *query {
+	params := params.Values{
+		"list":    "categorymembers",
+		"cmtitle": category,
+		"cmtype":  "file",
+		"cmsort":  "timestamp",
+		"cmdir":   backString(state.flags.Back),
+		"cmlimit": strconv.Itoa(state.flags.BatchSize),
+	}
+	if start.valid {
+		params["cmstart"] = start.string
+	}
+	if end.valid {
+		params["cmend"] = end.string
+	}
+	return newQuery(state.client, params)
+}
+
+// Return the titles of the subcategories of a category.
+func subcategories(category string, state *state) []string {
+	params := params.Values{
+		"list":    "categorymembers",
+		"cmtitle": category,
+		"cmtype":  "subcat",
+		"cmlimit": "max",
+	}
+	var titles []string
+	query := newQuery(state.client, params)
+	for query.Next() {
+		titles = append(titles, memberTitles(query.Resp())...)
+	}
+	if query.Err() != nil {
+		panic(query.Err())
+	}
+	return titles
+}
+
+// Return the titles from a list=categorymembers response.
+func memberTitles(resp *jason.Object) []string {
+	members, err := resp.GetObjectArray("query", "categorymembers")
+	if err != nil {
+		panic(err)
+	}
+	titles := make([]string, len(members))
+	for i := range members {
+		if titles[i], err = members[i].GetString("title"); err != nil {
+			panic(err)
+		}
+	}
+	return titles
+}
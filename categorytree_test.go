@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCategoryFilter(t *testing.T) {
+	tests := []struct {
+		include, exclude []string
+		name             string
+		want             bool
+	}{
+		{nil, nil, "Photos by Alice", true},
+		{nil, []string{"drafts"}, "Photos by Alice (drafts)", false},
+		{nil, []string{"drafts", "^Videos"}, "Videos by Alice", false},
+		{[]string{"^Photos"}, nil, "Photos by Alice", true},
+		{[]string{"^Photos", "2019$"}, nil, "Videos by Alice 2019", true},
+		{[]string{"^Photos"}, nil, "Videos by Alice", false},
+		// Exclusion wins over inclusion.
+		{[]string{"^Photos"}, []string{"drafts"}, "Photos by Alice (drafts)", false},
+	}
+	for _, test := range tests {
+		filter, err := newCategoryFilter(test.include, test.exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := filter.allows(test.name); got != test.want {
+			t.Errorf("%q %q %q: got %v, want %v", test.include, test.exclude, test.name, got, test.want)
+		}
+	}
+	if _, err := newCategoryFilter([]string{"("}, nil); err == nil {
+		t.Error("no error for a bad include pattern")
+	}
+	if _, err := newCategoryFilter(nil, []string{"("}); err == nil {
+		t.Error("no error for a bad exclude pattern")
+	}
+}
+
+func TestCategoryDepth(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	wiki.addPage("Category:Photos by Alice", "[[Category:Photos by Alice in Paris]]")
+	wiki.addPage("Category:Photos by Alice 2019", "[[Category:Photos by Alice]]")
+	wiki.addPage("Category:Photos by Alice in Paris", "[[Category:Photos by Alice 2019]]")
+	wiki.addPage("Category:Photos by Alice (drafts)", "[[Category:Photos by Alice]]")
+	wiki.addFile("File:P1.jpg", "Alice", "20190201000000", "Canon", "Canon EOS 5D", "[[Category:Photos by Alice]]\n[[Category:Photos by Alice 2019]]")
+	wiki.addFile("File:P2.jpg", "Alice", "20190202000000", "Canon", "Canon EOS 5D", "[[Category:Photos by Alice 2019]]")
+	wiki.addFile("File:P3.jpg", "Alice", "20190203000000", "Canon", "Canon EOS 5D", "[[Category:Photos by Alice in Paris]]")
+	wiki.addFile("File:P4.jpg", "Alice", "20190204000000", "Canon", "Canon EOS 5D", "[[Category:Photos by Alice (drafts)]]")
+	run := []string{"Category:Photos by Alice"}
+
+	checkStats(t, runTestCommand(t, wiki, run, "--depth", "1", "--excludecategory", "drafts").stats, stats{examined: 2, withCamera: 2, edited: 2})
+	// The cycle back to the top category is ignored, and files in several
+	// categories are examined once.
+	checkStats(t, runTestCommand(t, wiki, run, "--depth", "3", "--excludecategory", "drafts").stats, stats{examined: 3, withCamera: 3, inCat: 2, edited: 1})
+	checkStats(t, runTestCommand(t, wiki, run, "--depth", "3", "--includecategory", `\(drafts\)$`).stats, stats{examined: 2, withCamera: 2, inCat: 1, edited: 1})
+	if got := wiki.editedTitles(); strings.Join(got, ",") != "File:P1.jpg,File:P2.jpg,File:P3.jpg,File:P4.jpg" {
+		t.Errorf("got edits %v", got)
+	}
+}
+
+func TestCategoryTreeOneRun(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	wiki.addPage("User:Bot/Warnings", "old")
+	wiki.addPage("Category:Photos by Alice", "")
+	wiki.addPage("Category:Photos by Alice 2019", "[[Category:Photos by Alice]]")
+	wiki.addFile("File:P1.jpg", "Alice", "20190201000000", "Unknown", "Thing", "[[Category:Photos by Alice]]")
+	wiki.addFile("File:P2.jpg", "Alice", "20190202000000", "Canon", "Canon EOS 5D", "[[Category:Photos by Alice]]")
+	wiki.addFile("File:P3.jpg", "Alice", "20190203000000", "Foo Corp", "X1", "[[Category:Photos by Alice 2019]]")
+	wiki.addFile("File:P4.jpg", "Alice", "20190204000000", "Canon", "Canon EOS 5D", "[[Category:Photos by Alice 2019]]")
+	state := newTestState(t, wiki, "--depth", "1", "--gallery", "User:Bot/Warnings", "--batchsize", "1")
+	runCommand([]string{"Category:Photos by Alice"}, state)
+
+	// The gallery has the warnings from every category, and the file
+	// count of each target category is looked up once.
+	checkStats(t, state.stats, stats{examined: 4, withCamera: 4, warnings: 2, edited: 2})
+	checkText(t, wiki, "User:Bot/Warnings", "<gallery>\nFile:P3.jpg|Category:Taken with Foo cameras doesn't exist\nFile:P1.jpg|Unknown Thing\n</gallery>")
+	if got := wiki.props["categoryinfo"]; got != 2 {
+		t.Errorf("got %d categoryinfo queries, want 2", got)
+	}
+}
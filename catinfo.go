@@ -1,7 +1,6 @@
 package main
 
 import (
-	mwclient "cgt.name/pkg/go-mwclient"
 	"cgt.name/pkg/go-mwclient/params"
 	"github.com/garyhouston/takenwith/mwlib"
 )
@@ -10,48 +9,75 @@ import (
 // exists, return the number of files that it contains. The result arrays
 // give category names (in arbitrary order) and the corresponding count,
 // and will have fewer entries than the input array if some categories
-// were duplicated or didn't exist.
-func catNumFiles(categories []string, client *mwclient.Client) ([]string, []int32) {
-	params := params.Values{
-		"action": "query",
-		"titles": mwlib.MakeTitleString(categories),
-		"prop":   "categoryinfo",
-	}
-	json, err := client.Post(params) // Get may fail on long queries.
-	if err != nil {
-		panic(err)
-	}
-	pages, err := json.GetObjectArray("query", "pages")
-	if err != nil {
-		panic(err)
-	}
-	var resultCats = make([]string, len(pages))
-	var resultCounts = make([]int32, len(pages))
-	found := 0
-	for idx, _ := range pages {
-		pageObj, err := pages[idx].Object()
-		if err != nil {
-			panic(err)
-		}
-		missing, err := pageObj.GetBoolean("missing")
-		if err == nil && missing {
-			continue
+// were duplicated or didn't exist. Categories are named as given, even if
+// the Wiki normalises the names. They are requested in chunks of at most
+// titleLimit.
+func catNumFiles(categories []string, client wiki, titleLimit int) ([]string, []int32) {
+	counts := make(map[string]int32)
+	var resultCats []string
+	for start := 0; start < len(categories); start += titleLimit {
+		end := start + titleLimit
+		if end > len(categories) {
+			end = len(categories)
 		}
-		resultCats[found], err = pageObj.GetString("title")
-		if err != nil {
-			panic(err)
+		params := params.Values{
+			"titles": mwlib.MakeTitleString(categories[start:end]),
+			"prop":   "categoryinfo",
 		}
-		info, err := pageObj.GetObject("categoryinfo")
-		// An error here means that the category is probably
-		// empty, so just leave count at 0.
-		if err == nil {
-			files, err := info.GetInt64("files")
+		// Post, since Get may fail on long queries.
+		query := newPostQuery(client, params)
+		for query.Next() {
+			requested := requestedTitles(query.Resp(), categories[start:end])
+			pages, err := query.Resp().GetObjectArray("query", "pages")
 			if err != nil {
 				panic(err)
 			}
-			resultCounts[found] = int32(files)
+			for idx := range pages {
+				pageObj, err := pages[idx].Object()
+				if err != nil {
+					panic(err)
+				}
+				missing, err := pageObj.GetBoolean("missing")
+				if err == nil && missing {
+					continue
+				}
+				title, err := pageObj.GetString("title")
+				if err != nil {
+					panic(err)
+				}
+				titles := requested[title]
+				if titles == nil {
+					titles = []string{title}
+				}
+				var files int64
+				info, err := pageObj.GetObject("categoryinfo")
+				// An error here means that the category is
+				// probably empty, so just leave count at 0.
+				hasInfo := err == nil
+				if hasInfo {
+					files, err = info.GetInt64("files")
+					if err != nil {
+						panic(err)
+					}
+				}
+				for _, title := range titles {
+					if _, found := counts[title]; !found {
+						resultCats = append(resultCats, title)
+						counts[title] = 0
+					}
+					if hasInfo {
+						counts[title] = int32(files)
+					}
+				}
+			}
+		}
+		if query.Err() != nil {
+			panic(query.Err())
 		}
-		found++
+	}
+	resultCounts := make([]int32, len(resultCats))
+	for i := range resultCats {
+		resultCounts[i] = counts[resultCats[i]]
 	}
 	return resultCats, resultCounts
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	goflags "github.com/jessevdk/go-flags"
+	"os"
+	"strings"
+)
+
+// A config file sets options in INI format, using the long option names.
+// Settings before the first section apply to every profile, and each
+// section is a named profile whose settings take precedence over them.
+// E.g.:
+//
+//	operator = Example
+//	mappingfile = /home/example/takenwith/catmapping
+//
+//	[testwiki]
+//	api = https://test.wikimedia.org/w/api.php
+//	gallery = User:Example/Warnings
+//	targetprefix = "Taken with "
+//
+// Options given as flags or environment variables override the config file.
+
+// Settings from one section of a config file, in order.
+type configSection struct {
+	names []string
+	lines map[string][]string // Option name -> lines setting it.
+}
+
+func (s *configSection) add(name, line string) {
+	if s.lines[name] == nil {
+		s.names = append(s.names, name)
+	}
+	s.lines[name] = append(s.lines[name], line)
+}
+
+// Read a config file into sections. The unnamed section is "".
+func readConfig(configFile string) (map[string]*configSection, error) {
+	file, err := os.Open(configFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	newSection := func() *configSection {
+		return &configSection{lines: make(map[string][]string)}
+	}
+	sections := map[string]*configSection{"": newSection()}
+	section := sections[""]
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("%s:%d: malformed section header", configFile, lineNo)
+			}
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if sections[name] == nil {
+				sections[name] = newSection()
+			}
+			section = sections[name]
+			continue
+		}
+		pos := strings.Index(line, "=")
+		if pos < 0 {
+			return nil, fmt.Errorf("%s:%d: expected name = value", configFile, lineNo)
+		}
+		section.add(strings.TrimSpace(line[:pos]), line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sections, nil
+}
+
+// Return true if an option was given on the command line or in the
+// environment.
+func explicitlySet(option *goflags.Option) bool {
+	if option.IsSet() && !option.IsSetDefault() {
+		return true
+	}
+	if option.EnvDefaultKey != "" {
+		if _, found := os.LookupEnv(option.EnvDefaultKey); found {
+			return true
+		}
+	}
+	return false
+}
+
+// Set options from a config file and the named profile in it, if not blank,
+// where they weren't already set by flags or the environment.
+func applyConfig(parser *goflags.Parser, configFile string, profile string) error {
+	sections, err := readConfig(configFile)
+	if err != nil {
+		return err
+	}
+	use := []*configSection{sections[""]}
+	if profile != "" {
+		section, found := sections[profile]
+		if !found {
+			return errors.New("Profile " + profile + " not found in " + configFile)
+		}
+		use = append(use, section)
+	}
+	// Collect the lines that apply, with profile settings replacing the
+	// general ones.
+	settings := make(map[string][]string)
+	var names []string
+	for _, section := range use {
+		for _, name := range section.names {
+			option := parser.FindOptionByLongName(name)
+			if option == nil || name == "config" || name == "profile" {
+				return errors.New(configFile + ": unknown option " + name)
+			}
+			if explicitlySet(option) {
+				continue
+			}
+			if settings[name] == nil {
+				names = append(names, name)
+			}
+			settings[name] = section.lines[name]
+		}
+	}
+	var builder strings.Builder
+	for _, name := range names {
+		for _, line := range settings[name] {
+			builder.WriteString(line + "\n")
+		}
+	}
+	return goflags.NewIniParser(parser).Parse(strings.NewReader(builder.String()))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+const testConfig = `# Settings for all profiles.
+operator = Example
+batchsize = 20
+filelimit = 500
+
+[testwiki]
+api = https://test.wikimedia.org/w/api.php
+filelimit = 50
+targetprefix = "Photographed with "
+verbose = true
+
+[audit]
+ignorecurrentcats = true
+`
+
+func TestConfigProfile(t *testing.T) {
+	config := writeTestFile(t, t.TempDir(), "takenwith.ini", testConfig)
+	t.Setenv("takenwith_batchsize", "30")
+	args, flags, err := parseArgs([]string{"--config", config, "--profile", "testwiki", "--operator", "Flag", "User:Example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 1 || args[0] != "User:Example" {
+		t.Errorf("args %v", args)
+	}
+	// Flags and the environment take precedence, then the profile, then
+	// the general settings, then the defaults.
+	if flags.Operator != "Flag" {
+		t.Errorf("operator %q", flags.Operator)
+	}
+	if flags.BatchSize != 30 {
+		t.Errorf("batch size %d", flags.BatchSize)
+	}
+	if flags.FileLimit != 50 {
+		t.Errorf("file limit %d", flags.FileLimit)
+	}
+	if flags.API != "https://test.wikimedia.org/w/api.php" || flags.TargetPrefix != "Photographed with " || !flags.Verbose {
+		t.Errorf("profile not applied: %+v", flags)
+	}
+	if flags.IgnoreCurrentCats {
+		t.Error("setting from another profile applied")
+	}
+	if flags.WarningLimit != 100 {
+		t.Errorf("warning limit %d", flags.WarningLimit)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	config := writeTestFile(t, dir, "takenwith.ini", testConfig)
+	if _, _, err := parseArgs([]string{"--config", config, "--profile", "nothing"}); err == nil {
+		t.Error("no error for unknown profile")
+	}
+	if _, _, err := parseArgs([]string{"--profile", "testwiki"}); err == nil {
+		t.Error("no error for profile without config file")
+	}
+	bad := writeTestFile(t, dir, "bad.ini", "nosuchoption = 1\n")
+	if _, _, err := parseArgs([]string{"--config", bad}); err == nil {
+		t.Error("no error for unknown option")
+	}
+	if _, _, err := parseArgs([]string{"--config", filepath.Join(dir, "missing.ini")}); err == nil {
+		t.Error("no error for missing config file")
+	}
+}
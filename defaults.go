@@ -0,0 +1,76 @@
+package main
+
+import (
+	_ "embed"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The repository's mapping files, used unless overridden by flags.
+
+//go:embed catmapping
+var defaultMapping string
+
+//go:embed catexceptions
+var defaultExceptions string
+
+//go:embed catregex
+var defaultRegex string
+
+// A mapping file, either on disk or embedded in the binary.
+type source struct {
+	name     string // Path of the file, or name of the embedded file.
+	embedded bool   // True if data holds the file contents.
+	data     string
+}
+
+func (s source) open() (io.ReadCloser, error) {
+	if s.embedded {
+		return io.NopCloser(strings.NewReader(s.data)), nil
+	}
+	return os.Open(s.name)
+}
+
+// Return the sources for one kind of mapping file, in the order they
+// are loaded: the files given by a flag, or the embedded default if none,
+// then a local file if not blank. A directory stands for the files in it,
+// in name order, skipping hidden and backup files.
+func mappingSources(files []string, local string, defaultName string, defaultData string) ([]source, error) {
+	var sources []source
+	if len(files) == 0 {
+		sources = append(sources, source{name: "embedded " + defaultName, embedded: true, data: defaultData})
+	}
+	if local != "" {
+		files = append(files[:len(files):len(files)], local)
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			sources = append(sources, source{name: file})
+			continue
+		}
+		entries, err := os.ReadDir(file)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+				continue
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			sources = append(sources, source{name: filepath.Join(file, name)})
+		}
+	}
+	return sources, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	mwclient "cgt.name/pkg/go-mwclient"
+	"errors"
+)
+
+// Returned for every edit once logging in again has failed to give a
+// session that passes the edit assertion.
+var errNoSession = errors.New("Not logged in: logging in again didn't give a session that passes the edit assertion")
+
+// Makes every edit to the Wiki, subject to the edit limiter.
+type editor struct {
+	client  wiki
+	limiter *editLimiter
+	assert  string      // "user" or "bot", sent with every edit.
+	relogin func() bool // Log in again after the session has expired.
+	failed  bool        // Logging in again didn't help, so edits have stopped.
+}
+
+// Return true if an edit failed because the session has expired.
+func assertFailed(err error) bool {
+	apiErr, ok := err.(mwclient.APIError)
+	return ok && (apiErr.Code == "assertuserfailed" || apiErr.Code == "assertbotfailed")
+}
+
+// Make an edit. Capped edits count towards the maximum number of edits for
+// the run. If the session has expired, log in again and retry, so that the
+// edit isn't made anonymously. If that doesn't work, errNoSession is
+// returned for this and every later edit, without logging in again.
+func (e *editor) edit(editcfg map[string]string, capped bool) error {
+	if e.failed {
+		return errNoSession
+	}
+	if err := e.limiter.wait(capped); err != nil {
+		return err
+	}
+	editcfg["assert"] = e.assert
+	err := e.client.Edit(editcfg)
+	if assertFailed(err) {
+		if e.relogin() {
+			// The edit token belonged to the old session.
+			delete(editcfg, "token")
+			err = e.client.Edit(editcfg)
+		}
+		if assertFailed(err) {
+			e.failed = true
+			err = errNoSession
+		}
+	}
+	e.limiter.done(capped, err)
+	return err
+}
+
+// Return true if edits have stopped because logging in again didn't help.
+func (e *editor) stopped() bool {
+	return e.failed
+}
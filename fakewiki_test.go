@@ -0,0 +1,811 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A page in the fake Wiki.
+type fakePage struct {
+	title     string
+	ns        int
+	text      string
+	timestamp string     // Upload time for files, YYYYMMDDHHMMSS.
+	user      string     // Uploader of files.
+	metadata  [][]string // Name/value pairs returned as commonmetadata.
+	sha1      string     // SHA-1 of the file's current version.
+	logID     int        // ID of the upload log entry for files.
+}
+
+// A recorded edit.
+type fakeEdit struct {
+	title   string
+	summary string
+}
+
+// In-process fake of the parts of the MediaWiki action API used by the bot.
+type fakeWiki struct {
+	mutex    sync.Mutex
+	t        *testing.T
+	server   *httptest.Server
+	pages    map[string]*fakePage
+	username string
+	password string
+	sessions map[string]bool
+	edits    []fakeEdit
+	requests int
+	props    map[string]int // Number of queries for each prop.
+	bot      bool           // True if the account has the apihighlimits right.
+	catLimit int            // Maximum categories per query, if not 500.
+	logIDs   int            // Last upload log ID.
+	logLimit int            // Maximum log events per query, if not 500.
+	random   int            // Offset of the next random files.
+	catName  string         // Local name of the category namespace.
+	lagged   int            // Number of edit requests to refuse with a maxlag error.
+	limited  int            // Number of edits to refuse with a ratelimited error.
+}
+
+const fakeSessionCookie = "fakewikiSession"
+
+func newFakeWiki(t *testing.T) *fakeWiki {
+	w := &fakeWiki{
+		t:        t,
+		pages:    make(map[string]*fakePage),
+		username: "Bot",
+		password: "secret",
+		sessions: make(map[string]bool),
+		props:    make(map[string]int),
+		catName:  "Category",
+	}
+	w.server = httptest.NewServer(http.HandlerFunc(w.handle))
+	t.Cleanup(w.server.Close)
+	return w
+}
+
+func (w *fakeWiki) url() string {
+	return w.server.URL + "/w/api.php"
+}
+
+// Add a file page. make and model are stored as Exif metadata if not blank.
+func (w *fakeWiki) addFile(title, user, timestamp, make, model, text string) *fakePage {
+	page := &fakePage{title: title, ns: 6, text: text, timestamp: timestamp, user: user, sha1: fmt.Sprintf("%x", sha1.Sum([]byte(title+timestamp)))}
+	if make != "" {
+		page.metadata = append(page.metadata, []string{"Make", make})
+	}
+	if model != "" {
+		page.metadata = append(page.metadata, []string{"Model", model})
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.logIDs++
+	page.logID = w.logIDs
+	w.pages[title] = page
+	return page
+}
+
+var fakeRedirectLink = regexp.MustCompile(`^#REDIRECT \[\[([^\]]+)\]\]`)
+
+// Return the target of a redirect page, or blank if the page isn't one.
+func (w *fakeWiki) redirectTarget(title string) string {
+	page, found := w.pages[title]
+	if !found {
+		return ""
+	}
+	if match := fakeRedirectLink.FindStringSubmatch(page.text); match != nil {
+		return w.normalise(match[1])
+	}
+	return ""
+}
+
+// Add a page that isn't a file, e.g., a category or gallery.
+func (w *fakeWiki) addPage(title, text string) {
+	ns := 0
+	if w.isCategory(title) {
+		ns = 14
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.pages[title] = &fakePage{title: title, ns: ns, text: text, timestamp: "20200101000000"}
+}
+
+// Return the current text of a page.
+func (w *fakeWiki) text(title string) string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	page, found := w.pages[title]
+	if !found {
+		w.t.Fatalf("fake wiki: %s not found", title)
+	}
+	return page.text
+}
+
+// End all login sessions.
+func (w *fakeWiki) expireSessions() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.sessions = make(map[string]bool)
+}
+
+func (w *fakeWiki) editCount() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.edits)
+}
+
+// Return the titles of pages that were edited, in order.
+func (w *fakeWiki) editedTitles() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	titles := make([]string, len(w.edits))
+	for i := range w.edits {
+		titles[i] = w.edits[i].title
+	}
+	return titles
+}
+
+var fakeCategoryLink = regexp.MustCompile(`\[\[([^:|\]]+):([^|\]]+)(\|[^\]]*)?\]\]`)
+var fakeFileLink = regexp.MustCompile(`(?m)(?:\[\[|^)(File:[^|\]\n]+)`)
+
+// Normalise a title as MediaWiki would: underscores to spaces and an upper
+// case first letter in the namespace and name.
+func fakeNormalise(title string) string {
+	title = strings.TrimSpace(strings.Replace(title, "_", " ", -1))
+	upper := func(s string) string {
+		if s == "" {
+			return s
+		}
+		return strings.ToUpper(s[:1]) + s[1:]
+	}
+	if pos := strings.Index(title, ":"); pos > 0 {
+		ns := upper(title[:pos])
+		if ns == "Image" {
+			ns = "File"
+		}
+		return ns + ":" + upper(strings.TrimSpace(title[pos+1:]))
+	}
+	return upper(title)
+}
+
+// Normalise a title as the Wiki would, using the local name of the
+// category namespace.
+func (w *fakeWiki) normalise(title string) string {
+	title = fakeNormalise(title)
+	if strings.HasPrefix(title, "Category:") {
+		return w.catName + strings.TrimPrefix(title, "Category")
+	}
+	return title
+}
+
+// Return true if a title is in the category namespace, by its canonical or
+// local name.
+func (w *fakeWiki) isCategory(title string) bool {
+	return strings.HasPrefix(w.normalise(title), w.catName+":")
+}
+
+// Return the categories of a page, by their normalised titles.
+func (w *fakeWiki) categories(p *fakePage) []string {
+	var cats []string
+	for _, match := range fakeCategoryLink.FindAllStringSubmatch(p.text, -1) {
+		if title := w.normalise(match[1] + ":" + match[2]); w.isCategory(title) {
+			cats = append(cats, title)
+		}
+	}
+	return cats
+}
+
+// Return true if a page matches a simple search query.
+func (p *fakePage) matches(search string) bool {
+	content := p.title + "\n" + p.text
+	for _, pair := range p.metadata {
+		content += "\n" + pair[1]
+	}
+	content = strings.ToLower(content)
+	for _, term := range strings.Fields(strings.ToLower(search)) {
+		if strings.HasPrefix(term, "-") {
+			if strings.Contains(content, term[1:]) {
+				return false
+			}
+		} else if !strings.Contains(content, term) {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *fakeWiki) inCategory(p *fakePage, category string) bool {
+	for _, cat := range w.categories(p) {
+		if cat == category {
+			return true
+		}
+	}
+	return false
+}
+
+// Return pages in the file namespace sorted by timestamp.
+func (w *fakeWiki) files(descending bool) []*fakePage {
+	var files []*fakePage
+	for _, page := range w.pages {
+		if page.ns == 6 {
+			files = append(files, page)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].timestamp == files[j].timestamp {
+			return files[i].title < files[j].title
+		}
+		if descending {
+			return files[i].timestamp > files[j].timestamp
+		}
+		return files[i].timestamp < files[j].timestamp
+	})
+	return files
+}
+
+// Reduce an API timestamp to YYYYMMDDHHMMSS.
+func fakeTimestamp(ts string) string {
+	digits := make([]byte, 0, 14)
+	for i := 0; i < len(ts); i++ {
+		if ts[i] >= '0' && ts[i] <= '9' {
+			digits = append(digits, ts[i])
+		}
+	}
+	return string(digits)
+}
+
+// Return true if a page's timestamp is within the start/end range for the
+// direction of the listing.
+func inRange(page *fakePage, start, end string, descending bool) bool {
+	ts := page.timestamp
+	start = fakeTimestamp(start)
+	end = fakeTimestamp(end)
+	if descending {
+		return (start == "" || ts <= start) && (end == "" || ts >= end)
+	}
+	return (start == "" || ts >= start) && (end == "" || ts <= end)
+}
+
+// Convert YYYYMMDDHHMMSS to the ISO 8601 format of API responses.
+func fakeISOTime(ts string) string {
+	return ts[0:4] + "-" + ts[4:6] + "-" + ts[6:8] + "T" + ts[8:10] + ":" + ts[10:12] + ":" + ts[12:14] + "Z"
+}
+
+type object map[string]interface{}
+
+func (w *fakeWiki) writeJSON(rw http.ResponseWriter, resp interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(resp); err != nil {
+		w.t.Error(err)
+	}
+}
+
+func apiError(code, info string) object {
+	return object{"error": object{"code": code, "info": info}}
+}
+
+func (w *fakeWiki) loggedIn(r *http.Request) bool {
+	cookie, err := r.Cookie(fakeSessionCookie)
+	return err == nil && w.sessions[cookie.Value]
+}
+
+func (w *fakeWiki) handle(rw http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		w.t.Error(err)
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.requests++
+	if prop := r.Form.Get("prop"); prop != "" {
+		w.props[prop]++
+	}
+	// Only edits are lagged, so that the queries around them succeed.
+	if r.Form.Get("action") == "edit" && r.Form.Get("maxlag") != "" && w.lagged > 0 {
+		w.lagged--
+		rw.Header().Set("X-Database-Lag", "6")
+		rw.Header().Set("Retry-After", "0")
+		w.writeJSON(rw, apiError("maxlag", "Waiting for db1: 6 seconds lagged."))
+		return
+	}
+	switch r.Form.Get("assert") {
+	case "user", "bot":
+		if !w.loggedIn(r) {
+			w.writeJSON(rw, apiError("assert"+r.Form.Get("assert")+"failed", "Assertion that the user is logged in failed."))
+			return
+		}
+		if r.Form.Get("assert") == "bot" && !w.bot {
+			w.writeJSON(rw, apiError("assertbotfailed", "Assertion that the user has the \"bot\" right failed."))
+			return
+		}
+	}
+	switch r.Form.Get("action") {
+	case "query":
+		w.writeJSON(rw, w.query(r))
+	case "login":
+		w.writeJSON(rw, w.login(rw, r))
+	case "edit":
+		w.writeJSON(rw, w.edit(r))
+	default:
+		w.writeJSON(rw, apiError("badvalue", "Unrecognized value for parameter \"action\"."))
+	}
+}
+
+func (w *fakeWiki) login(rw http.ResponseWriter, r *http.Request) object {
+	if r.Form.Get("lgtoken") != "logintoken+\\" {
+		return object{"login": object{"result": "WrongToken"}}
+	}
+	if r.Form.Get("lgname") != w.username || r.Form.Get("lgpassword") != w.password {
+		return object{"login": object{"result": "Failed", "reason": "Incorrect username or password entered."}}
+	}
+	session := "session" + strconv.Itoa(w.requests)
+	w.sessions[session] = true
+	http.SetCookie(rw, &http.Cookie{Name: fakeSessionCookie, Value: session, Path: "/", MaxAge: 3600, HttpOnly: true})
+	return object{"login": object{"result": "Success", "lgusername": w.username}}
+}
+
+func (w *fakeWiki) edit(r *http.Request) object {
+	if r.Form.Get("token") != "csrftoken+\\" {
+		return apiError("badtoken", "Invalid CSRF token.")
+	}
+	if !w.loggedIn(r) {
+		return apiError("permissiondenied", "Anonymous edits aren't allowed.")
+	}
+	if w.limited > 0 {
+		w.limited--
+		return apiError("ratelimited", "As an anti-abuse measure, you are limited from performing this action too many times in a short space of time, and you have exceeded this limit. Please try again in a few minutes.")
+	}
+	title := w.normalise(r.Form.Get("title"))
+	page, found := w.pages[title]
+	if !found {
+		return apiError("missingtitle", "The page you specified doesn't exist.")
+	}
+	text := r.Form.Get("text")
+	if text == page.text {
+		return object{"edit": object{"result": "Success", "title": title, "nochange": true}}
+	}
+	page.text = text
+	w.edits = append(w.edits, fakeEdit{title, r.Form.Get("summary")})
+	return object{"edit": object{"result": "Success", "title": title}}
+}
+
+// Return a page object for a query response, with the requested props.
+func (w *fakeWiki) pageObject(title string, r *http.Request) object {
+	page, found := w.pages[title]
+	if !found {
+		ns := 0
+		if strings.HasPrefix(title, "File:") {
+			ns = 6
+		} else if w.isCategory(title) {
+			ns = 14
+		}
+		return object{"ns": ns, "title": title, "missing": true}
+	}
+	obj := object{"ns": page.ns, "title": page.title, "pageid": len(page.title)}
+	for _, prop := range strings.Split(r.Form.Get("prop"), "|") {
+		switch prop {
+		case "imageinfo":
+			if page.ns != 6 {
+				continue
+			}
+			metadata := make([]object, len(page.metadata))
+			for i := range page.metadata {
+				metadata[i] = object{"name": page.metadata[i][0], "value": page.metadata[i][1]}
+			}
+			info := object{"commonmetadata": metadata, "timestamp": fakeISOTime(page.timestamp)}
+			if strings.Contains(r.Form.Get("iiprop"), "sha1") {
+				info["sha1"] = page.sha1
+			}
+			obj["imageinfo"] = []object{info}
+		case "categories":
+			cats := w.categories(page)
+			if len(cats) == 0 {
+				continue
+			}
+			catObjs := make([]object, len(cats))
+			for i := range cats {
+				catObjs[i] = object{"ns": 14, "title": cats[i]}
+			}
+			obj["categories"] = catObjs
+		case "categoryinfo":
+			if page.ns != 14 {
+				continue
+			}
+			files := 0
+			for _, member := range w.pages {
+				if member.ns == 6 && w.inCategory(member, page.title) {
+					files++
+				}
+			}
+			obj["categoryinfo"] = object{"size": files, "pages": 0, "files": files, "subcats": 0}
+		case "revisions":
+			obj["revisions"] = []object{{
+				"timestamp": page.timestamp,
+				"slots":     object{"main": object{"contentmodel": "wikitext", "contentformat": "text/x-wiki", "content": page.text}},
+			}}
+		}
+	}
+	return obj
+}
+
+// Return the titles generated by a generator, the continuation parameters
+// if there are more, and the warnings if the limit was over the maximum.
+func (w *fakeWiki) generate(r *http.Request) ([]string, object, object) {
+	form := r.Form
+	var pages []*fakePage
+	var prefix string
+	switch form.Get("generator") {
+	case "allimages":
+		prefix = "gai"
+		descending := form.Get("gaidir") == "descending"
+		for _, page := range w.files(descending) {
+			if form.Get("gaiuser") != "" && page.user != form.Get("gaiuser") {
+				continue
+			}
+			if inRange(page, form.Get("gaistart"), form.Get("gaiend"), descending) {
+				pages = append(pages, page)
+			}
+		}
+	case "categorymembers":
+		prefix = "gcm"
+		descending := form.Get("gcmdir") == "descending"
+		category := w.normalise(form.Get("gcmtitle"))
+		for _, page := range w.files(descending) {
+			if w.inCategory(page, category) && inRange(page, form.Get("gcmstart"), form.Get("gcmend"), descending) {
+				pages = append(pages, page)
+			}
+		}
+	case "images":
+		prefix = "gim"
+		page, found := w.pages[w.normalise(form.Get("titles"))]
+		if found {
+			for _, match := range fakeFileLink.FindAllStringSubmatch(page.text, -1) {
+				if file, found := w.pages[w.normalise(match[1])]; found {
+					pages = append(pages, file)
+				}
+			}
+		}
+	case "search":
+		// Every term must occur in the page, unless negated by "-".
+		prefix = "gsr"
+		for _, page := range w.files(false) {
+			if strconv.Itoa(page.ns) == form.Get("gsrnamespace") && page.matches(form.Get("gsrsearch")) {
+				pages = append(pages, page)
+			}
+		}
+	case "random":
+		// Cycle through the files.
+		prefix = "grn"
+		files := w.files(false)
+		limit, _ := strconv.Atoi(form.Get("grnlimit"))
+		for i := 0; i < limit && i < len(files); i++ {
+			pages = append(pages, files[(w.random+i)%len(files)])
+		}
+		w.random += len(pages)
+	default:
+		w.t.Errorf("fake wiki: unsupported generator %s", form.Get("generator"))
+		return nil, nil, nil
+	}
+	contKey := prefix + "continue"
+	if prefix == "gsr" {
+		contKey = "gsroffset"
+	}
+	offset, _ := strconv.Atoi(form.Get(contKey))
+	limit, err := strconv.Atoi(form.Get(prefix + "limit"))
+	if err != nil {
+		limit = 10
+	}
+	// Like MediaWiki, use the maximum and warn about it.
+	var warnings object
+	if max := w.generatorLimit(form.Get("generator")); limit > max {
+		warnings = object{form.Get("generator"): object{"warnings": fmt.Sprintf("The value \"%d\" for parameter \"%slimit\" must be between 1 and %d.", limit, prefix, max)}}
+		limit = max
+	}
+	if offset > len(pages) {
+		offset = len(pages)
+	}
+	end := offset + limit
+	var cont object
+	if end < len(pages) && prefix != "grn" {
+		cont = object{contKey: strconv.Itoa(end), "continue": contKey + "||"}
+	} else if end > len(pages) {
+		end = len(pages)
+	}
+	titles := make([]string, 0, end-offset)
+	for _, page := range pages[offset:end] {
+		titles = append(titles, page.title)
+	}
+	return titles, cont, warnings
+}
+
+// Return the maximum limit of a generator. Search has the lower limits
+// that MediaWiki gives to expensive modules.
+func (w *fakeWiki) generatorLimit(generator string) int {
+	if generator == "search" || generator == "random" {
+		return w.titleLimit()
+	}
+	if w.bot {
+		return 5000
+	}
+	return 500
+}
+
+func (w *fakeWiki) query(r *http.Request) object {
+	form := r.Form
+	query := object{}
+	resp := object{"batchcomplete": true, "query": query}
+	switch form.Get("meta") {
+	case "tokens":
+		tokens := object{}
+		for _, name := range strings.Split(form.Get("type"), "|") {
+			tokens[name+"token"] = name + "token+\\"
+		}
+		query["tokens"] = tokens
+		return resp
+	case "siteinfo":
+		query["namespaces"] = object{
+			"0":  object{"id": 0, "name": ""},
+			"2":  object{"id": 2, "name": "User", "canonical": "User"},
+			"6":  object{"id": 6, "name": "File", "canonical": "File"},
+			"14": object{"id": 14, "name": w.catName, "canonical": "Category"},
+		}
+		query["namespacealiases"] = []object{{"id": 6, "alias": "Image"}}
+		return resp
+	case "userinfo":
+		rights := []string{"read", "edit"}
+		if w.bot {
+			rights = append(rights, "apihighlimits")
+		}
+		query["userinfo"] = object{"id": 1, "name": w.username, "rights": rights}
+		return resp
+	}
+	if form.Get("list") == "logevents" {
+		return w.logEvents(r)
+	}
+	if form.Get("list") == "categorymembers" {
+		return w.categoryMembers(r)
+	}
+	var titles []string
+	if form.Get("generator") != "" {
+		var cont, warnings object
+		titles, cont, warnings = w.generate(r)
+		if warnings != nil {
+			resp["warnings"] = warnings
+		}
+		if cont != nil {
+			resp["continue"] = cont
+			delete(resp, "batchcomplete")
+		}
+		if len(titles) == 0 {
+			delete(resp, "query")
+			return resp
+		}
+	} else if form.Get("titles") != "" {
+		requested := strings.Split(form.Get("titles"), "|")
+		if limit := w.titleLimit(); len(requested) > limit {
+			return apiError("toomanyvalues", "Too many values supplied for parameter \"titles\". The limit is "+strconv.Itoa(limit)+".")
+		}
+		var normalized []object
+		var redirects []object
+		_, followRedirects := form["redirects"]
+		seen := make(map[string]bool)
+		for _, title := range requested {
+			norm := w.normalise(title)
+			if norm != title {
+				normalized = append(normalized, object{"fromencoded": false, "from": title, "to": norm})
+			}
+			if target := w.redirectTarget(norm); followRedirects && target != "" {
+				redirects = append(redirects, object{"from": norm, "to": target})
+				norm = target
+			}
+			if !seen[norm] {
+				titles = append(titles, norm)
+				seen[norm] = true
+			}
+		}
+		if normalized != nil {
+			query["normalized"] = normalized
+		}
+		if redirects != nil {
+			query["redirects"] = redirects
+		}
+	}
+	pages := make([]object, len(titles))
+	for i := range titles {
+		pages[i] = w.pageObject(titles[i], r)
+	}
+	query["pages"] = pages
+	if cont := w.limitCategories(pages, r); cont != nil && resp["continue"] == nil {
+		resp["continue"] = cont
+		delete(resp, "batchcomplete")
+	}
+	return resp
+}
+
+// Return the number of titles that may be given in a query.
+func (w *fakeWiki) titleLimit() int {
+	if w.bot {
+		return 500
+	}
+	return 50
+}
+
+// Apply cllimit across the categories of all the pages, as MediaWiki does,
+// returning the continuation if some were left out.
+func (w *fakeWiki) limitCategories(pages []object, r *http.Request) object {
+	limit := 500
+	if w.catLimit > 0 {
+		limit = w.catLimit
+	}
+	if n, err := strconv.Atoi(r.Form.Get("cllimit")); err == nil && n < limit {
+		limit = n
+	}
+	offset, _ := strconv.Atoi(r.Form.Get("clcontinue"))
+	pos := 0
+	for _, page := range pages {
+		cats, _ := page["categories"].([]object)
+		var kept []object
+		for _, cat := range cats {
+			if pos >= offset && pos < offset+limit {
+				kept = append(kept, cat)
+			}
+			pos++
+		}
+		if kept == nil {
+			delete(page, "categories")
+		} else {
+			page["categories"] = kept
+		}
+	}
+	if pos > offset+limit {
+		return object{"clcontinue": strconv.Itoa(offset + limit), "continue": "||"}
+	}
+	return nil
+}
+
+// Return upload log events from list=logevents, oldest first.
+func (w *fakeWiki) logEvents(r *http.Request) object {
+	form := r.Form
+	if form.Get("letype") != "upload" || form.Get("ledir") != "newer" {
+		w.t.Errorf("fake wiki: unsupported logevents query %v", form)
+	}
+	var events []object
+	for _, page := range w.files(false) {
+		if !inRange(page, form.Get("lestart"), form.Get("leend"), false) {
+			continue
+		}
+		events = append(events, object{"logid": page.logID, "ns": page.ns, "title": page.title, "timestamp": fakeISOTime(page.timestamp), "type": "upload", "action": "upload"})
+	}
+	offset, _ := strconv.Atoi(form.Get("lecontinue"))
+	limit, err := strconv.Atoi(form.Get("lelimit"))
+	if err != nil {
+		limit = 500
+	}
+	if w.logLimit > 0 && w.logLimit < limit {
+		limit = w.logLimit
+	}
+	if offset > len(events) {
+		offset = len(events)
+	}
+	end := offset + limit
+	resp := object{"batchcomplete": true}
+	if end < len(events) {
+		resp["continue"] = object{"lecontinue": strconv.Itoa(end), "continue": "-||"}
+		delete(resp, "batchcomplete")
+	} else {
+		end = len(events)
+	}
+	resp["query"] = object{"logevents": events[offset:end]}
+	return resp
+}
+
+// Return the files or subcategories of a category from
+// list=categorymembers. Files are sorted by timestamp, subcategories by
+// title.
+func (w *fakeWiki) categoryMembers(r *http.Request) object {
+	form := r.Form
+	category := w.normalise(form.Get("cmtitle"))
+	var members []object
+	switch form.Get("cmtype") {
+	case "file":
+		descending := form.Get("cmdir") == "descending"
+		for _, page := range w.files(descending) {
+			if w.inCategory(page, category) && inRange(page, form.Get("cmstart"), form.Get("cmend"), descending) {
+				members = append(members, object{"ns": page.ns, "title": page.title})
+			}
+		}
+	case "subcat":
+		var titles []string
+		for title, page := range w.pages {
+			if page.ns == 14 && w.inCategory(page, category) {
+				titles = append(titles, title)
+			}
+		}
+		sort.Strings(titles)
+		for _, title := range titles {
+			members = append(members, object{"ns": 14, "title": title})
+		}
+	default:
+		w.t.Errorf("fake wiki: unsupported categorymembers query %v", form)
+	}
+	offset, _ := strconv.Atoi(form.Get("cmcontinue"))
+	limit, err := strconv.Atoi(form.Get("cmlimit"))
+	if err != nil {
+		limit = 500
+	}
+	if offset > len(members) {
+		offset = len(members)
+	}
+	end := offset + limit
+	resp := object{"batchcomplete": true}
+	if end < len(members) {
+		resp["continue"] = object{"cmcontinue": strconv.Itoa(end), "continue": "-||"}
+		delete(resp, "batchcomplete")
+	} else {
+		end = len(members)
+	}
+	resp["query"] = object{"categorymembers": append([]object{}, members[offset:end]...)}
+	return resp
+}
+
+// In-process stand-in for an EventStreams server. Each connection sends the
+// events after the one named by Last-Event-ID, at most perConnection of
+// them, and is then closed, or held open if there are none left.
+type fakeStream struct {
+	mutex         sync.Mutex
+	server        *httptest.Server
+	events        []string // Data of the events, with IDs 1, 2, ...
+	perConnection int
+	lastIDs       []string // Last-Event-ID of each connection.
+}
+
+func newFakeStream(t *testing.T, perConnection int, events ...string) *fakeStream {
+	s := &fakeStream{events: events, perConnection: perConnection}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *fakeStream) handle(rw http.ResponseWriter, r *http.Request) {
+	lastID := r.Header.Get("Last-Event-ID")
+	s.mutex.Lock()
+	s.lastIDs = append(s.lastIDs, lastID)
+	s.mutex.Unlock()
+	next := 0
+	if lastID != "" {
+		next, _ = strconv.Atoi(lastID)
+	}
+	rw.Header().Set("Content-Type", "text/event-stream")
+	fmt.Fprint(rw, ": keepalive\nretry: 1\n\n")
+	for i := next; i < len(s.events) && i < next+s.perConnection; i++ {
+		fmt.Fprintf(rw, "event: message\nid: %d\ndata: %s\n\n", i+1, s.events[i])
+	}
+	rw.(http.Flusher).Flush()
+	if next >= len(s.events) {
+		<-r.Context().Done()
+	}
+}
+
+func (s *fakeStream) connections() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.lastIDs...)
+}
+
+// Data of a page-create event.
+func fakeCreateEvent(domain string, ns int, title string, redirect bool) string {
+	data, _ := json.Marshal(object{
+		"meta":             object{"domain": domain},
+		"page_namespace":   ns,
+		"page_title":       title,
+		"page_is_redirect": redirect,
+	})
+	return string(data)
+}
@@ -4,7 +4,8 @@ require (
 	cgt.name/pkg/go-mwclient v1.0.3
 	github.com/antonholmquist/jason v1.0.0
 	github.com/jessevdk/go-flags v1.4.0
-	github.com/mrjones/oauth v0.0.0-20190623134757-126b35219450 // indirect
 )
 
-go 1.13
+require github.com/mrjones/oauth v0.0.0-20190623134757-126b35219450 // indirect
+
+go 1.17
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How often cache files are saved during a run, so that little is lost if
+// the bot is killed.
+const cacheSaveInterval = time.Minute
+
+// Read a JSON file into v. Returns false without an error if the file
+// doesn't exist.
+func readJSONFile(path string, v interface{}) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Write v to a JSON file, replacing it atomically.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dir, file := filepath.Split(path)
+	writer, err := ioutil.TempFile(dir, file)
+	if err != nil {
+		return err
+	}
+	tmpFile := writer.Name()
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, path)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// Read file titles, one per line, e.g., exported from PetScan or Quarry.
+// The namespace prefix is optional, underscores may be used for spaces,
+// and blank lines and repeated titles are skipped.
+func readTitles(reader io.Reader, site *site) ([]string, error) {
+	var titles []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		title := strings.TrimSpace(strings.Replace(scanner.Text(), "_", " ", -1))
+		if title == "" {
+			continue
+		}
+		if !site.isFile(title) {
+			title = site.filePrefixes[0] + title
+		}
+		if !seen[title] {
+			titles = append(titles, title)
+			seen[title] = true
+		}
+	}
+	return titles, scanner.Err()
+}
+
+// Process the files listed in a file, or standard input if the path is "-".
+func processList(path string, state *state) {
+	reader := os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			warn.Print(err)
+			return
+		}
+		defer file.Close()
+		reader = file
+	}
+	titles, err := readTitles(reader, state.site)
+	if err != nil {
+		warn.Print(err)
+		return
+	}
+	processTitles(titles, state)
+}
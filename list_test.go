@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadTitles(t *testing.T) {
+	input := "A.jpg\n  File:B_c.jpg  \n\nImage:D.jpg\nA.jpg\nFile:A.jpg\n"
+	titles, err := readTitles(strings.NewReader(input), testSite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(titles, ","); got != "File:A.jpg,File:B c.jpg,Image:D.jpg" {
+		t.Errorf("got titles %q", got)
+	}
+	if titles, err := readTitles(strings.NewReader(""), testSite); titles != nil || err != nil {
+		t.Errorf("got %q, %v from empty input", titles, err)
+	}
+}
+
+func TestProcessList(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	list := writeTestFile(t, t.TempDir(), "list", "A.jpg\nFile:F.jpg\n\nExisting_1.jpg\nFile:Missing.jpg\nA.jpg\n")
+	state := runTestCommand(t, wiki, []string{"List:" + list})
+	if got := wiki.editedTitles(); strings.Join(got, ",") != "File:A.jpg,File:F.jpg" {
+		t.Errorf("got edits %v", got)
+	}
+	checkStats(t, state.stats, stats{examined: 4, withCamera: 2, warnings: 2, edited: 2})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// The category mappings loaded from the mapping files.
+type mappings struct {
+	categoryMap   map[string]string // makemodel -> category
+	allCategories map[string]bool   // All known categories, including those that aren't catmapping targets.
+	catRegex      []catRegex
+	regexIndex    *regexIndex
+}
+
+// The mapping files named by flags, and the mappings last loaded from them.
+// The files are checked for changes between batches and the mappings
+// replaced as a whole, so that the lookup of a batch uses a consistent set.
+type mappingFiles struct {
+	flags    flags
+	site     *site
+	mutex    sync.Mutex
+	current  *mappings
+	modTimes map[string]fileVersion // Path -> version when last loaded.
+}
+
+// Enough of a file's details to notice that it changed.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func newMappingFiles(flags flags, site *site) (*mappingFiles, error) {
+	m := &mappingFiles{flags: flags, site: site}
+	sources, err := m.sources()
+	if err != nil {
+		return nil, err
+	}
+	current, err := loadMappings(sources, site)
+	if err != nil {
+		return nil, err
+	}
+	m.current = current
+	m.modTimes = fileVersions(sources)
+	return m, nil
+}
+
+// Return the mapping, exception and regex sources, in that order.
+func (m *mappingFiles) sources() ([3][]source, error) {
+	var sources [3][]source
+	var err error
+	if sources[0], err = mappingSources(m.flags.MappingFile, m.flags.LocalMappingFile, "catmapping", defaultMapping); err != nil {
+		return sources, err
+	}
+	if sources[1], err = mappingSources(m.flags.ExceptionFile, m.flags.LocalExceptionFile, "catexceptions", defaultExceptions); err != nil {
+		return sources, err
+	}
+	sources[2], err = mappingSources(m.flags.RegexFile, m.flags.LocalRegexFile, "catregex", defaultRegex)
+	return sources, err
+}
+
+func loadMappings(sources [3][]source, site *site) (*mappings, error) {
+	var m mappings
+	var err error
+	if m.categoryMap, err = fillCategoryMap(sources[0], site); err != nil {
+		return nil, err
+	}
+	if m.allCategories, err = fillCategories(m.categoryMap, sources[1], site); err != nil {
+		return nil, err
+	}
+	if m.catRegex, err = fillRegex(sources[2], site); err != nil {
+		return nil, err
+	}
+	m.regexIndex = newRegexIndex(m.catRegex)
+	return &m, nil
+}
+
+// Versions of the files on disk, which are blank if they can't be read.
+func fileVersions(sources [3][]source) map[string]fileVersion {
+	versions := make(map[string]fileVersion)
+	for _, list := range sources {
+		for _, s := range list {
+			if s.embedded {
+				continue
+			}
+			var version fileVersion
+			if info, err := os.Stat(s.name); err == nil {
+				version = fileVersion{info.ModTime(), info.Size()}
+			}
+			versions[s.name] = version
+		}
+	}
+	return versions
+}
+
+func sameVersions(a, b map[string]fileVersion) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, version := range a {
+		if other, found := b[name]; !found || !other.modTime.Equal(version.modTime) || other.size != version.size {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the current mappings.
+func (m *mappingFiles) get() *mappings {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.current
+}
+
+// Reload the mappings if any of the files were changed, added or removed.
+// If the new files can't be loaded, keep using the old mappings.
+func (m *mappingFiles) reload() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sources, err := m.sources()
+	if err != nil {
+		warn.Print("Not reloading mapping files: ", err)
+		return
+	}
+	versions := fileVersions(sources)
+	if sameVersions(versions, m.modTimes) {
+		return
+	}
+	// Don't try again until there's another change.
+	m.modTimes = versions
+	current, err := loadMappings(sources, m.site)
+	if err != nil {
+		warn.Print("Not reloading mapping files: ", err)
+		return
+	}
+	m.current = current
+	warn.Print("Reloaded mapping files.")
+}
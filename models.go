@@ -3,53 +3,82 @@ package main
 import (
 	"bufio"
 	"encoding/csv"
+	"errors"
+	"fmt"
 	"io"
-	"os"
 	"regexp"
 	"strings"
 )
 
-func readCSV(mappingFile string, convert func(record []string)) {
-	file, err := os.Open(mappingFile)
+// Read a CSV mapping file, passing each record with at least the given
+// number of fields to convert. Stops at the first error.
+func readCSV(mappingFile source, fields int, convert func(record []string) error) error {
+	file, err := mappingFile.open()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer file.Close()
 	reader := csv.NewReader(bufio.NewReader(file))
+	reader.FieldsPerRecord = -1
 	for {
 		record, err := reader.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("%s: %v", mappingFile.name, err)
+		}
+		if len(record) < fields {
+			return fmt.Errorf("%s: expected %d fields: %s", mappingFile.name, fields, strings.Join(record, ","))
+		}
+		if err := convert(record); err != nil {
+			return fmt.Errorf("%s: %v", mappingFile.name, err)
 		}
-		convert(record)
 	}
+	return nil
 }
 
-func convertTarget(in string) string {
+func convertTarget(in string, site *site) (string, error) {
 	var out string
-	if strings.HasPrefix(in, "Category:") {
-		// use name as-is.
-		out = in
-	} else if strings.HasPrefix(in, "Taken with") {
+	if strings.TrimSpace(in) == "" {
+		return "", errors.New("Bad record in mapping file: blank category")
+	} else if site.isCategory(in) {
+		// use name as-is, apart from the namespace prefix.
+		out = site.category(in)
+	} else if site.targetPrefix != "" && strings.HasPrefix(in, strings.TrimSpace(site.targetPrefix)) {
 		// avoid accidental "Taken with Taken with".
-		panic("Bad record in mapping file: " + in)
+		return "", errors.New("Bad record in mapping file: " + in)
 	} else {
-		out = "Category:Taken with " + in
+		out = site.target(in)
 	}
-	return out
+	return out, nil
 }
 
-// Fill map with relations of makemodel -> Commons category
-func fillCategoryMap(mappingFile string) map[string]string {
+// Fill map with relations of makemodel -> Commons category. Entries in later
+// files override earlier ones, which is reported. Exact entries are always
+// used in preference to regex matches.
+func fillCategoryMap(mappingFiles []source, site *site) (map[string]string, error) {
 	categories := make(map[string]string)
-	convert := func(record []string) {
-		categories[record[0]+record[1]] = convertTarget(record[2])
+	origins := make(map[string]string) // makemodel -> file of the entry.
+	for _, mappingFile := range mappingFiles {
+		convert := func(record []string) error {
+			key := record[0] + record[1]
+			target, err := convertTarget(record[2], site)
+			if err != nil {
+				return err
+			}
+			if old, found := categories[key]; found && old != target && origins[key] != mappingFile.name {
+				warn.Printf("%s: %s,%s -> %s overrides %s from %s", mappingFile.name, record[0], record[1], target, old, origins[key])
+			}
+			categories[key] = target
+			origins[key] = mappingFile.name
+			return nil
+		}
+		if err := readCSV(mappingFile, 3, convert); err != nil {
+			return nil, err
+		}
 	}
-	readCSV(mappingFile, convert)
-	return categories
+	return categories, nil
 }
 
 type catRegex struct {
@@ -57,38 +86,75 @@ type catRegex struct {
 	target string
 }
 
-// Read regular expressions for category matches.
-func fillRegex(regexFile string) []catRegex {
+// Read regular expressions for category matches. They are tried in order,
+// so the entries of later files are placed before those of earlier files.
+// A pattern repeated in a later file replaces the earlier entry, which is
+// reported.
+func fillRegex(regexFiles []source, site *site) ([]catRegex, error) {
 	regexes := make([]catRegex, 0, 200)
-	convert := func(record []string) {
-		regex, err := regexp.Compile(record[0])
-		if err != nil {
-			panic(err)
+	origins := make(map[string]string) // pattern -> file of the entry.
+	for _, regexFile := range regexFiles {
+		fileRegexes := make([]catRegex, 0, 200)
+		patterns := make(map[string]bool)
+		convert := func(record []string) error {
+			regex, err := regexp.Compile(record[0])
+			if err != nil {
+				return err
+			}
+			target, err := convertTarget(record[1], site)
+			if err != nil {
+				return err
+			}
+			fileRegexes = append(fileRegexes, catRegex{regex, target})
+			patterns[record[0]] = true
+			return nil
+		}
+		if err := readCSV(regexFile, 2, convert); err != nil {
+			return nil, err
+		}
+		for _, r := range regexes {
+			pattern := r.regex.String()
+			if patterns[pattern] {
+				warn.Printf("%s: %s overrides the entry from %s", regexFile.name, pattern, origins[pattern])
+				continue
+			}
+			fileRegexes = append(fileRegexes, r)
 		}
-		regexes = append(regexes, catRegex{regex, convertTarget(record[1])})
+		for pattern := range patterns {
+			origins[pattern] = regexFile.name
+		}
+		regexes = fileRegexes
 	}
-	readCSV(regexFile, convert)
-	return regexes
+	return regexes, nil
 }
 
 // Fill the complete set of relevant Commons Categories.
-func fillCategories(categoryMap map[string]string, exceptionFile string) map[string]bool {
+func fillCategories(categoryMap map[string]string, exceptionFiles []source, site *site) (map[string]bool, error) {
 	categories := make(map[string]bool)
 	for _, v := range categoryMap {
 		categories[v] = true
 	}
 	// Add the categories that aren't catmapping targets.
-	file, err := os.Open(exceptionFile)
+	for _, exceptionFile := range exceptionFiles {
+		if err := readExceptions(exceptionFile, categories, site); err != nil {
+			return nil, err
+		}
+	}
+	return categories, nil
+}
+
+func readExceptions(exceptionFile source, categories map[string]bool, site *site) error {
+	file, err := exceptionFile.open()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer file.Close()
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		if err := scanner.Err(); err != nil {
-			panic(err)
-		}
-		categories["Category:"+scanner.Text()] = true
+		categories[site.categoryPrefix+scanner.Text()] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %v", exceptionFile.name, err)
 	}
-	return categories
+	return nil
 }
@@ -2,42 +2,151 @@ package mwlib
 
 import (
 	"bufio"
-	"io"
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
-func ReadCookies(cookieFile string) []*http.Cookie {
-	file, err := os.Open(cookieFile)
+// Version of the cookie file format written by WriteCookies. Version 1 was
+// lines of "name value", which ReadCookies still accepts.
+const cookieFileVersion = 2
+
+type cookieStore struct {
+	Version int           `json:"version"`
+	Cookies []cookieEntry `json:"cookies"`
+}
+
+type cookieEntry struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Domain   string     `json:"domain,omitempty"`
+	Path     string     `json:"path,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+	HttpOnly bool       `json:"httponly,omitempty"`
+}
+
+// Make an entry for a cookie. A Max-Age attribute is converted to an expiry
+// time from now.
+func newCookieEntry(cookie *http.Cookie, now time.Time) cookieEntry {
+	entry := cookieEntry{
+		Name:     cookie.Name,
+		Value:    cookie.Value,
+		Domain:   cookie.Domain,
+		Path:     cookie.Path,
+		Secure:   cookie.Secure,
+		HttpOnly: cookie.HttpOnly,
+	}
+	if cookie.MaxAge > 0 {
+		expires := now.Add(time.Duration(cookie.MaxAge) * time.Second).UTC()
+		entry.Expires = &expires
+	} else if !cookie.Expires.IsZero() {
+		expires := cookie.Expires.UTC()
+		entry.Expires = &expires
+	}
+	return entry
+}
+
+func (entry cookieEntry) cookie() *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     entry.Name,
+		Value:    entry.Value,
+		Domain:   entry.Domain,
+		Path:     entry.Path,
+		Secure:   entry.Secure,
+		HttpOnly: entry.HttpOnly,
+	}
+	if entry.Expires != nil {
+		cookie.Expires = *entry.Expires
+	}
+	return cookie
+}
+
+func (entry cookieEntry) expired(now time.Time) bool {
+	return entry.Expires != nil && entry.Expires.Before(now)
+}
+
+// Parse the original format of "name value" lines. A truncated last line
+// is ignored.
+func parseVersion1(data []byte) []cookieEntry {
+	entries := []cookieEntry{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		pos := strings.Index(line, " ")
+		if pos <= 0 {
+			continue
+		}
+		entries = append(entries, cookieEntry{Name: line[:pos], Value: line[pos+1:]})
+	}
+	return entries
+}
+
+// Read the entries in a cookie file, without expired entries. Returns nil if
+// the file doesn't exist or can't be parsed.
+func readEntries(cookieFile string) []cookieEntry {
+	data, err := ioutil.ReadFile(cookieFile)
 	if err != nil {
 		return nil
 	}
-	defer file.Close()
-	reader := bufio.NewReader(file)
-	cookies := []*http.Cookie{}
-	for i := 0; ; i++ {
-		name, err := reader.ReadString(' ')
-		if err == io.EOF {
-			return cookies
-		}
-		if err != nil {
-			panic(err)
+	var entries []cookieEntry
+	if len(bytes.TrimSpace(data)) > 0 && bytes.TrimSpace(data)[0] == '{' {
+		var store cookieStore
+		if json.Unmarshal(data, &store) != nil || store.Version > cookieFileVersion {
+			return nil
 		}
-		name = name[:len(name)-1]
-		value, err := reader.ReadString('\n')
-		if err != nil {
-			panic(err)
+		entries = store.Cookies
+	} else {
+		entries = parseVersion1(data)
+	}
+	now := time.Now()
+	result := entries[:0]
+	for _, entry := range entries {
+		if !entry.expired(now) {
+			result = append(result, entry)
 		}
-		value = value[:len(value)-1]
-		cookies = append(cookies, &http.Cookie{Name: name, Value: value})
 	}
+	return result
+}
+
+// Read the unexpired cookies saved in a cookie file, with their attributes.
+// Returns nil if the file doesn't exist or can't be parsed.
+func ReadCookies(cookieFile string) []*http.Cookie {
+	unlock := lockFile(cookieFile, false)
+	defer unlock()
+	entries := readEntries(cookieFile)
+	if entries == nil {
+		return nil
+	}
+	cookies := make([]*http.Cookie, len(entries))
+	for i := range entries {
+		cookies[i] = entries[i].cookie()
+	}
+	return cookies
 }
 
+// Save cookies to a cookie file, replacing its contents. Cookies obtained
+// from a cookie jar have only a name and value, so pass them through
+// CookieAttributes.Complete first.
 func WriteCookies(cookies []*http.Cookie, cookieFile string) {
-	// Write to a temp file to avoid corruption if another instance writes simultaneously
-	// (we don't care which one wins.)
+	unlock := lockFile(cookieFile, true)
+	defer unlock()
+	now := time.Now()
+	store := cookieStore{Version: cookieFileVersion, Cookies: make([]cookieEntry, 0, len(cookies))}
+	for i := range cookies {
+		store.Cookies = append(store.Cookies, newCookieEntry(cookies[i], now))
+	}
+	data, err := json.MarshalIndent(store, "", " ")
+	if err != nil {
+		panic(err)
+	}
+	// Write to a temp file so that the file is replaced atomically.
 	dir, file := filepath.Split(cookieFile)
 	writer, err := ioutil.TempFile(dir, file)
 	if err != nil {
@@ -48,16 +157,71 @@ func WriteCookies(cookies []*http.Cookie, cookieFile string) {
 	if err != nil {
 		panic(err)
 	}
-	for i := range cookies {
-		writer.WriteString(cookies[i].Name)
-		writer.WriteString(" ")
-		writer.WriteString(cookies[i].Value)
-		writer.WriteString("\n")
+	_, err = writer.Write(data)
+	if err != nil {
+		panic(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		panic(err)
 	}
-	writer.Close()
 	err = os.Rename(tmpFile, cookieFile)
 	if err != nil {
 		panic(err)
 	}
+}
 
+// The attributes of the cookies set by the Wiki, which a cookie jar doesn't
+// return. It's given to mwclient.Client.SetDebug as the writer of the
+// client's request and response dumps while logging in, and reads the
+// Set-Cookie headers of the responses.
+type CookieAttributes struct {
+	mutex   sync.Mutex
+	entries map[string]cookieEntry // name=value -> entry.
+}
+
+func NewCookieAttributes() *CookieAttributes {
+	return &CookieAttributes{entries: make(map[string]cookieEntry)}
+}
+
+// Remember the attributes of cookies, e.g., those read from a cookie file.
+// Cookies being deleted are ignored, since the jar won't return them.
+func (a *CookieAttributes) Add(cookies []*http.Cookie) {
+	now := time.Now()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, cookie := range cookies {
+		if cookie.MaxAge < 0 {
+			continue
+		}
+		a.entries[cookie.Name+"="+cookie.Value] = newCookieEntry(cookie, now)
+	}
+}
+
+// Read the cookies set in a dumped response. Dumped requests are ignored.
+func (a *CookieAttributes) Write(dump []byte) (int, error) {
+	if bytes.HasPrefix(dump, []byte("HTTP/")) {
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(dump)), nil)
+		if err == nil {
+			resp.Body.Close()
+			a.Add(resp.Cookies())
+		}
+	}
+	return len(dump), nil
+}
+
+// Return cookies from a cookie jar with the attributes they were set with,
+// where known.
+func (a *CookieAttributes) Complete(cookies []*http.Cookie) []*http.Cookie {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	result := make([]*http.Cookie, len(cookies))
+	for i, cookie := range cookies {
+		if entry, found := a.entries[cookie.Name+"="+cookie.Value]; found {
+			result[i] = entry.cookie()
+		} else {
+			result[i] = cookie
+		}
+	}
+	return result
 }
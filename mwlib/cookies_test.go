@@ -0,0 +1,106 @@
+package mwlib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCookieFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "cookies")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadVersion1Cookies(t *testing.T) {
+	path := writeCookieFile(t, "session abc\ntoken a b\nbroken\n")
+	cookies := ReadCookies(path)
+	if len(cookies) != 2 || cookies[0].Name != "session" || cookies[0].Value != "abc" || cookies[1].Name != "token" || cookies[1].Value != "a b" {
+		t.Errorf("got cookies %v", cookies)
+	}
+}
+
+func TestReadTruncatedCookies(t *testing.T) {
+	// A truncated JSON file can't be used at all.
+	if cookies := ReadCookies(writeCookieFile(t, `{"version":2,"cookies":[{"name":"session","val`)); cookies != nil {
+		t.Errorf("got cookies %v from truncated file", cookies)
+	}
+	if cookies := ReadCookies(writeCookieFile(t, `{"version":3,"cookies":[]}`)); cookies != nil {
+		t.Errorf("got cookies %v from newer version", cookies)
+	}
+	if cookies := ReadCookies(filepath.Join(t.TempDir(), "missing")); cookies != nil {
+		t.Errorf("got cookies %v from missing file", cookies)
+	}
+}
+
+func TestWriteCookies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cookies")
+	now := time.Now()
+	WriteCookies([]*http.Cookie{
+		{Name: "session", Value: "abc", Domain: "example.org", Path: "/", HttpOnly: true, Secure: true},
+		{Name: "old", Value: "x", Path: "/", Expires: now.Add(-time.Hour)},
+		{Name: "token", Value: "y", Path: "/w", MaxAge: 3600},
+	}, path)
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("got file info %v, %v", info, err)
+	}
+
+	// The expired entry is dropped, and Max-Age becomes an expiry time.
+	cookies := ReadCookies(path)
+	if len(cookies) != 2 {
+		t.Fatalf("got cookies %v", cookies)
+	}
+	session := cookies[0]
+	if session.Name != "session" || session.Value != "abc" || session.Domain != "example.org" || session.Path != "/" || !session.HttpOnly || !session.Secure || !session.Expires.IsZero() {
+		t.Errorf("got session cookie %+v", session)
+	}
+	token := cookies[1]
+	if token.Name != "token" || token.Path != "/w" || token.Expires.Before(now.Add(59*time.Minute)) || token.Expires.After(now.Add(61*time.Minute)) {
+		t.Errorf("got token cookie %+v", token)
+	}
+}
+
+func TestCookieAttributes(t *testing.T) {
+	attributes := NewCookieAttributes()
+	attributes.Add([]*http.Cookie{{Name: "saved", Value: "1", Domain: "example.org", Path: "/"}})
+
+	// Set-Cookie headers are read from response dumps.
+	recorder := httptest.NewRecorder()
+	http.SetCookie(recorder, &http.Cookie{Name: "session", Value: "abc", Path: "/", HttpOnly: true, MaxAge: 60})
+	http.SetCookie(recorder, &http.Cookie{Name: "gone", Value: "x", MaxAge: -1})
+	dump, err := httputil.DumpResponse(recorder.Result(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := attributes.Write([]byte("GET /w/api.php HTTP/1.1\r\nHost: example.org\r\n\r\n")); n == 0 || err != nil {
+		t.Errorf("request dump: got %d, %v", n, err)
+	}
+	if n, err := attributes.Write(dump); n != len(dump) || err != nil {
+		t.Errorf("response dump: got %d, %v", n, err)
+	}
+
+	// A jar returns only names and values.
+	cookies := attributes.Complete([]*http.Cookie{
+		{Name: "saved", Value: "1"},
+		{Name: "session", Value: "abc"},
+		{Name: "session", Value: "other"},
+	})
+	if c := cookies[0]; c.Domain != "example.org" || c.Path != "/" {
+		t.Errorf("got saved cookie %+v", c)
+	}
+	if c := cookies[1]; c.Path != "/" || !c.HttpOnly || c.Expires.IsZero() {
+		t.Errorf("got session cookie %+v", c)
+	}
+	if c := cookies[2]; c.Path != "" || c.HttpOnly {
+		t.Errorf("got cookie with another value %+v", c)
+	}
+	if _, found := attributes.entries["gone=x"]; found {
+		t.Error("deleted cookie kept")
+	}
+}
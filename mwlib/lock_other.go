@@ -0,0 +1,10 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package mwlib
+
+// File locking isn't supported on this platform. Concurrent instances of
+// the bot can still rely on files being replaced atomically.
+func lockFile(path string, exclusive bool) func() {
+	return func() {}
+}
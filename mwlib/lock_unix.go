@@ -0,0 +1,32 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package mwlib
+
+import (
+	"os"
+	"syscall"
+)
+
+// Lock a file against other instances of the bot, using a separate lock file
+// since the file itself may be replaced. Returns a function to release the
+// lock.
+func lockFile(path string, exclusive bool) func() {
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		// Proceed without a lock, e.g., if the directory is read-only.
+		return func() {}
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(lock.Fd()), how); err != nil {
+		lock.Close()
+		return func() {}
+	}
+	return func() {
+		syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+		lock.Close()
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+)
+
+// Credentials of an owner-only OAuth 1.0a consumer.
+type oauthKeys struct {
+	consumerToken  string
+	consumerSecret string
+	accessToken    string
+	accessSecret   string
+}
+
+// Read OAuth credentials from a file with lines of the form name=value,
+// with names consumer_token, consumer_secret, access_token and
+// access_secret. Blank lines and lines starting with # are ignored.
+func readOAuthKeys(oauthFile string) (oauthKeys, error) {
+	var keys oauthKeys
+	file, err := os.Open(oauthFile)
+	if err != nil {
+		return keys, err
+	}
+	defer file.Close()
+	fields := map[string]*string{
+		"consumer_token":  &keys.consumerToken,
+		"consumer_secret": &keys.consumerSecret,
+		"access_token":    &keys.accessToken,
+		"access_secret":   &keys.accessSecret,
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pos := strings.Index(line, "=")
+		if pos < 0 {
+			return keys, errors.New(oauthFile + ": expected name=value: " + line)
+		}
+		field, found := fields[strings.TrimSpace(line[:pos])]
+		if !found {
+			return keys, errors.New(oauthFile + ": unknown name: " + line[:pos])
+		}
+		*field = strings.TrimSpace(line[pos+1:])
+	}
+	if err := scanner.Err(); err != nil {
+		return keys, err
+	}
+	for name, field := range fields {
+		if *field == "" {
+			return keys, errors.New(oauthFile + ": " + name + " not set")
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadOAuthKeys(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "oauth", "# Owner-only consumer\n\nconsumer_token = ct\nconsumer_secret=cs\n  access_token=at=x\naccess_secret=as\n")
+	keys, err := readOAuthKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (oauthKeys{"ct", "cs", "at=x", "as"}); keys != want {
+		t.Errorf("got %+v, want %+v", keys, want)
+	}
+
+	tests := []struct {
+		content string
+		want    string // Part of the error.
+	}{
+		{"consumer_token=ct\nconsumer_secret=cs\naccess_token=at\n", "access_secret not set"},
+		{"consumer_token=ct\nconsumer_secret=cs\naccess_token=at\naccess_secret=\n", "access_secret not set"},
+		{"consumer_token=ct\nconsumer_key=ck\n", "unknown name: consumer_key"},
+		{"consumer_token ct\n", "expected name=value"},
+	}
+	for _, test := range tests {
+		_, err := readOAuthKeys(writeTestFile(t, dir, "oauth", test.content))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got error %v, want %q", test.content, err, test.want)
+		}
+	}
+	if _, err := readOAuthKeys(filepath.Join(dir, "missing")); err == nil {
+		t.Error("no error for a missing file")
+	}
+}
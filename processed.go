@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Version of the processed file format.
+const processedVersion = 1
+
+type processedStore struct {
+	Version int                       `json:"version"`
+	Files   map[string]processedEntry `json:"files"` // Title -> entry.
+}
+
+// A file that needed no further action when last processed.
+type processedEntry struct {
+	SHA1   string `json:"sha1"`   // SHA-1 of the file's current version.
+	Target string `json:"target"` // Category mapped from its Exif.
+}
+
+// Files handled in earlier runs, which are skipped unless the file has been
+// re-uploaded or the mapping files now give a different category for its
+// Exif make and model.
+type processedCache struct {
+	path  string
+	mutex sync.Mutex
+	files map[string]processedEntry
+	dirty bool
+	saved time.Time
+}
+
+// Read the processed file, if it exists. Returns nil if path is blank.
+func readProcessed(path string) (*processedCache, error) {
+	if path == "" {
+		return nil, nil
+	}
+	var store processedStore
+	found, err := readJSONFile(path, &store)
+	if err != nil {
+		return nil, err
+	}
+	if found && store.Version != processedVersion {
+		warn.Printf("%s: ignoring processed file version %d", path, store.Version)
+		store.Files = nil
+	}
+	if store.Files == nil {
+		store.Files = make(map[string]processedEntry)
+	}
+	return &processedCache{path: path, files: store.Files, saved: time.Now()}, nil
+}
+
+// Return true if the file was handled in an earlier run with the same
+// version and target category.
+func (c *processedCache) handled(title, sha1, target string) bool {
+	if c == nil || sha1 == "" || target == "" {
+		return false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, found := c.files[title]
+	return found && entry.SHA1 == sha1 && entry.Target == target
+}
+
+// Record the files in a batch that needed no further action.
+func (c *processedCache) record(files []fileData) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i := range files {
+		if files[i].handled && files[i].sha1 != "" && files[i].catMapped != "" {
+			c.files[files[i].title] = processedEntry{files[i].sha1, files[i].catMapped}
+			c.dirty = true
+		}
+	}
+}
+
+// Save the processed file if it changed since it was last saved.
+func (c *processedCache) save() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.dirty {
+		return
+	}
+	if err := writeJSONFile(c.path, processedStore{processedVersion, c.files}); err != nil {
+		warn.Print("Can't save processed files: ", err)
+		return
+	}
+	c.dirty = false
+	c.saved = time.Now()
+}
+
+// Save the processed file if it's been a while, so that little is lost if
+// the bot is killed.
+func (c *processedCache) saveIfDue() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	due := time.Since(c.saved) >= cacheSaveInterval
+	c.mutex.Unlock()
+	if due {
+		c.save()
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessedCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "processed")
+	cache, err := readProcessed(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.record([]fileData{
+		{title: "File:A.jpg", sha1: "a", catMapped: "Category:Taken with Canon EOS 5D", handled: true},
+		{title: "File:B.jpg", sha1: "b", catMapped: "Category:Taken with Nikon D90"},
+		{title: "File:C.jpg", catMapped: "Category:Taken with Nikon D90", handled: true},
+	})
+	cache.save()
+
+	// Only handled files with a version and target are recorded, and a
+	// re-upload or new target means the file isn't handled.
+	cache, err = readProcessed(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		title, sha1, target string
+		want                bool
+	}{
+		{"File:A.jpg", "a", "Category:Taken with Canon EOS 5D", true},
+		{"File:A.jpg", "a2", "Category:Taken with Canon EOS 5D", false},
+		{"File:A.jpg", "a", "Category:Taken with Canon 5D", false},
+		{"File:A.jpg", "", "", false},
+		{"File:B.jpg", "b", "Category:Taken with Nikon D90", false},
+		{"File:C.jpg", "", "Category:Taken with Nikon D90", false},
+	}
+	for _, test := range tests {
+		if got := cache.handled(test.title, test.sha1, test.target); got != test.want {
+			t.Errorf("%s %q %q: got %v, want %v", test.title, test.sha1, test.target, got, test.want)
+		}
+	}
+
+	// Files from another version of the format are ignored.
+	other := writeTestFile(t, t.TempDir(), "processed", `{"version":2,"files":{"File:A.jpg":{"sha1":"a","target":"Category:Taken with Canon EOS 5D"}}}`)
+	if cache, err := readProcessed(other); err != nil || cache.handled("File:A.jpg", "a", "Category:Taken with Canon EOS 5D") {
+		t.Errorf("newer version used: %v", err)
+	}
+
+	// Without a path nothing is recorded.
+	if cache, err := readProcessed(""); cache != nil || err != nil || cache.handled("File:A.jpg", "a", "Category:Taken with Canon EOS 5D") {
+		t.Errorf("got %v, %v without a path", cache, err)
+	}
+}
+
+func TestProcessedFile(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	dir := t.TempDir()
+	processed := filepath.Join(dir, "processed")
+	run := []string{"User:Alice"}
+	checkStats(t, runTestCommand(t, wiki, run, "--processedfile", processed).stats, stats{examined: 5, withCamera: 4, warnings: 2, inCat: 1, edited: 1})
+
+	// A.jpg was edited and B.jpg already categorised, so only B.jpg is
+	// skipped after A.jpg is re-uploaded.
+	wiki.pages["File:A.jpg"].sha1 = "reuploaded"
+	wiki.addFile("File:G.jpg", "Alice", "20190107000000", "NIKON CORPORATION", "NIKON D90", "")
+	checkStats(t, runTestCommand(t, wiki, run, "--processedfile", processed).stats, stats{examined: 6, withCamera: 5, warnings: 3, inCat: 1, handled: 1, edited: 1})
+
+	// Changing the mapping for Canon EOS 5D affects A.jpg and B.jpg, but
+	// G.jpg is still skipped.
+	wiki.addPage("Category:Taken with Canon 5D", "")
+	local := writeTestFile(t, dir, "local", "Canon,Canon EOS 5D,Canon 5D\n")
+	known := writeTestFile(t, dir, "known", "Taken with Canon EOS 5D\n")
+	checkStats(t, runTestCommand(t, wiki, run, "--processedfile", processed, "--localmappingfile", local, "--localexceptionfile", known).stats, stats{examined: 6, withCamera: 5, warnings: 2, inCat: 2, handled: 1})
+}
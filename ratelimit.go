@@ -0,0 +1,139 @@
+package main
+
+import (
+	mwclient "cgt.name/pkg/go-mwclient"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Returned when the maximum number of edits for the run has been made.
+var errEditCap = errors.New("Maximum number of edits for this run reached")
+
+// How long to pause edits when the server says it's overloaded.
+const overloadPause = time.Duration(60) * time.Second
+
+// The edit interval may grow up to this multiple of the configured interval
+// while the server is reporting lag.
+const maxSlowdown = 8
+
+// Token bucket limiting the rate of edits. It's shared by everything that
+// writes to the Wiki, and slows down when the server reports lag.
+type editLimiter struct {
+	mutex     sync.Mutex
+	base      time.Duration       // Configured time to accrue one token.
+	interval  time.Duration       // Current time to accrue one token.
+	burst     float64             // Maximum number of tokens.
+	tokens    float64             // Tokens available at time last.
+	last      time.Time           // Time of last refill.
+	notBefore time.Time           // No edits until this time.
+	maxEdits  int32               // Maximum number of capped edits, or 0 for no limit.
+	edits     int32               // Number of successful capped edits.
+	now       func() time.Time    // Clock, replaced in tests.
+	sleep     func(time.Duration) // Sleep on the same clock.
+}
+
+// Create a limiter allowing rate edits per minute, with up to burst edits
+// at once and up to maxEdits capped edits in total (no limit if zero).
+func newEditLimiter(rate float64, burst int, maxEdits int32) *editLimiter {
+	if rate <= 0 {
+		panic("Edit rate must be positive")
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	interval := time.Duration(float64(time.Minute) / rate)
+	return &editLimiter{
+		base:     interval,
+		interval: interval,
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		last:     time.Now(),
+		maxEdits: maxEdits,
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+func (l *editLimiter) refill(now time.Time) {
+	l.tokens += float64(now.Sub(l.last)) / float64(l.interval)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// Wait until an edit may be made. Capped edits count towards the maximum
+// number of edits for the run, and errEditCap is returned once it's reached.
+func (l *editLimiter) wait(capped bool) error {
+	for {
+		l.mutex.Lock()
+		if capped && l.maxEdits > 0 && l.edits >= l.maxEdits {
+			l.mutex.Unlock()
+			return errEditCap
+		}
+		now := l.now()
+		l.refill(now)
+		var delay time.Duration
+		if l.tokens < 1 {
+			delay = time.Duration((1 - l.tokens) * float64(l.interval))
+		}
+		if pause := l.notBefore.Sub(now); pause > delay {
+			delay = pause
+		}
+		if delay <= 0 {
+			l.tokens--
+			if l.tokens < 0 {
+				l.tokens = 0
+			}
+			l.mutex.Unlock()
+			return nil
+		}
+		// Sleep without the lock, so that the limiter can be updated and
+		// checked meanwhile, and then check again.
+		l.mutex.Unlock()
+		l.sleep(delay)
+	}
+}
+
+// Update the limiter with the result of an edit.
+func (l *editLimiter) done(capped bool, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if overloaded(err) {
+		// Pause, and edit more slowly until the server recovers.
+		l.notBefore = l.now().Add(overloadPause)
+		l.interval *= 2
+		if l.interval > l.base*maxSlowdown {
+			l.interval = l.base * maxSlowdown
+		}
+		return
+	}
+	if err == nil {
+		if capped {
+			l.edits++
+		}
+		// Return gradually to the configured rate.
+		l.interval -= (l.interval - l.base) / 4
+	}
+}
+
+// Return true if the maximum number of edits for the run has been made.
+func (l *editLimiter) capReached() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.maxEdits > 0 && l.edits >= l.maxEdits
+}
+
+// Return true if an error indicates that the server wants us to slow down.
+// mwclient has already waited for the server's Retry-After time and retried
+// before returning ErrAPIBusy.
+func overloaded(err error) bool {
+	if err == mwclient.ErrAPIBusy {
+		return true
+	}
+	if apiErr, ok := err.(mwclient.APIError); ok {
+		return apiErr.Code == "maxlag" || apiErr.Code == "ratelimited"
+	}
+	return false
+}
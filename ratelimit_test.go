@@ -0,0 +1,206 @@
+package main
+
+import (
+	mwclient "cgt.name/pkg/go-mwclient"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock for the edit limiter that only moves when the limiter sleeps or
+// the test advances it.
+type fakeClock struct {
+	mutex   sync.Mutex
+	time    time.Time
+	slept   time.Duration // Total time slept.
+	onSleep func()        // Called before each sleep.
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.time
+}
+
+func (c *fakeClock) sleep(d time.Duration) {
+	if c.onSleep != nil {
+		c.onSleep()
+	}
+	c.advance(d)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.slept += d
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.time = c.time.Add(d)
+}
+
+func (c *fakeClock) totalSlept() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.slept
+}
+
+// Make a limiter use a fake clock.
+func useFakeClock(l *editLimiter) *fakeClock {
+	clock := &fakeClock{time: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.now, l.sleep, l.last = clock.now, clock.sleep, clock.time
+	return clock
+}
+
+func TestEditLimiterTokenBucket(t *testing.T) {
+	limiter := newEditLimiter(60, 2, 0)
+	clock := useFakeClock(limiter)
+	wait := func(want time.Duration) {
+		t.Helper()
+		if err := limiter.wait(false); err != nil {
+			t.Fatal(err)
+		}
+		if got := clock.totalSlept(); got != want {
+			t.Errorf("slept %v in total, want %v", got, want)
+		}
+	}
+
+	// The burst is allowed at once, and then an edit a second.
+	wait(0)
+	wait(0)
+	wait(time.Second)
+	wait(2 * time.Second)
+
+	// Tokens don't accrue beyond the burst.
+	clock.advance(time.Minute)
+	wait(2 * time.Second)
+	wait(2 * time.Second)
+	wait(3 * time.Second)
+}
+
+func TestEditLimiterSlowdown(t *testing.T) {
+	limiter := newEditLimiter(60, 1, 0)
+	clock := useFakeClock(limiter)
+	base := limiter.base
+
+	// The server asking us to slow down pauses edits, and halves the rate.
+	limiter.wait(false)
+	limiter.done(false, mwclient.ErrAPIBusy)
+	if limiter.interval != 2*base {
+		t.Errorf("got interval %v, want %v", limiter.interval, 2*base)
+	}
+	limiter.wait(false)
+	if got := clock.totalSlept(); got != overloadPause {
+		t.Errorf("slept %v, want %v", got, overloadPause)
+	}
+
+	// Other errors don't change the rate, and the slowdown is limited.
+	limiter.done(false, mwclient.APIError{Code: "badtoken"})
+	if limiter.interval != 2*base {
+		t.Errorf("got interval %v after another error", limiter.interval)
+	}
+	for _, err := range []error{
+		mwclient.APIError{Code: "maxlag"},
+		mwclient.APIError{Code: "ratelimited"},
+		mwclient.ErrAPIBusy,
+		mwclient.ErrAPIBusy,
+	} {
+		limiter.done(false, err)
+	}
+	if limiter.interval != maxSlowdown*base {
+		t.Errorf("got interval %v, want %v", limiter.interval, maxSlowdown*base)
+	}
+
+	// Successful edits gradually return to the configured rate.
+	limiter.done(false, nil)
+	if want := maxSlowdown*base - (maxSlowdown-1)*base/4; limiter.interval != want {
+		t.Errorf("got interval %v after an edit, want %v", limiter.interval, want)
+	}
+	for i := 0; i < 100; i++ {
+		limiter.done(false, nil)
+	}
+	if limiter.interval-base > time.Millisecond {
+		t.Errorf("got interval %v after recovering, want %v", limiter.interval, base)
+	}
+}
+
+func TestEditLimiterMaxEdits(t *testing.T) {
+	limiter := newEditLimiter(60000, 10, 2)
+	useFakeClock(limiter)
+	for i := 0; i < 2; i++ {
+		if err := limiter.wait(true); err != nil {
+			t.Fatal(err)
+		}
+		// Failed edits and uncapped edits don't count.
+		limiter.done(true, errors.New("failed"))
+		limiter.done(false, nil)
+		if limiter.capReached() {
+			t.Fatalf("cap reached after %d edits", i)
+		}
+		limiter.done(true, nil)
+	}
+	if !limiter.capReached() {
+		t.Error("cap not reached")
+	}
+	if err := limiter.wait(true); err != errEditCap {
+		t.Errorf("got %v, want errEditCap", err)
+	}
+	if err := limiter.wait(false); err != nil {
+		t.Errorf("uncapped edit: got %v", err)
+	}
+}
+
+func TestEditLimiterSleepsUnlocked(t *testing.T) {
+	limiter := newEditLimiter(60, 1, 0)
+	clock := useFakeClock(limiter)
+	clock.onSleep = func() {
+		checked := make(chan struct{})
+		go func() {
+			limiter.capReached()
+			limiter.done(false, nil)
+			close(checked)
+		}()
+		select {
+		case <-checked:
+		case <-time.After(time.Second):
+			t.Error("limiter locked while waiting")
+		}
+	}
+	limiter.wait(false)
+	limiter.wait(false)
+	if clock.totalSlept() == 0 {
+		t.Error("didn't wait")
+	}
+}
+
+func TestEditOverloaded(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(*fakeWiki)
+	}{
+		// mwclient retries on maxlag, and returns ErrAPIBusy when it's
+		// still lagged.
+		{"maxlag", func(w *fakeWiki) { w.lagged = 3 }},
+		{"ratelimited", func(w *fakeWiki) { w.limited = 1 }},
+	}
+	for _, test := range tests {
+		wiki := newFakeWiki(t)
+		addTestFiles(wiki)
+		state := newTestState(t, wiki)
+		clock := useFakeClock(state.editor.limiter)
+		test.set(wiki)
+		runCommand([]string{"File:A.jpg"}, state)
+
+		// The edit is made after the pause, and the rate is still reduced.
+		checkStats(t, state.stats, stats{withCamera: 1, edited: 1})
+		if got := clock.totalSlept(); got < overloadPause {
+			t.Errorf("%s: slept %v, want at least %v", test.name, got, overloadPause)
+		}
+		limiter := state.editor.limiter
+		if want := 2*limiter.base - limiter.base/4; limiter.interval != want {
+			t.Errorf("%s: got interval %v, want %v", test.name, limiter.interval, want)
+		}
+	}
+}
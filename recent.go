@@ -0,0 +1,131 @@
+package main
+
+import (
+	"cgt.name/pkg/go-mwclient/params"
+	"github.com/antonholmquist/jason"
+	"strconv"
+	"time"
+)
+
+// Position in the upload log reached by the Recent command.
+type recentPosition struct {
+	Timestamp string `json:"timestamp"` // Time of the last upload processed.
+	LogID     int64  `json:"logid"`     // Log ID of the last upload processed.
+}
+
+// Follow new uploads, starting from the timestamp if valid, else from the
+// position saved in the recent file, else from now. The files are
+// processed as they are found, with one warning gallery and set of category
+// counts for the whole run, and the position saved as each page of the
+// upload log is completed. Runs until a limit other than FileLimit stops
+// processing.
+func processRecent(ts timestamp, state *state) {
+	var position recentPosition
+	if ts.valid {
+		position.Timestamp = ts.string
+	} else if state.flags.RecentFile != "" {
+		found, err := readJSONFile(state.flags.RecentFile, &position)
+		if err != nil {
+			panic(err)
+		}
+		if found {
+			warn.Print("Continuing from ", position.Timestamp)
+		}
+	}
+	if position.Timestamp == "" {
+		position.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	}
+	// Following uploads doesn't end, so FileLimit doesn't apply.
+	processSource(uploadSource(position, state), 0, state)
+}
+
+// Return a source of the titles of the files uploaded after the position,
+// a page of the upload log at a time. When the end of the log is reached,
+// it's checked again every PollInterval.
+func uploadSource(position recentPosition, state *state) titleSource {
+	var query *query
+	return func(stop <-chan struct{}) ([]string, func(), bool) {
+		for {
+			if query == nil {
+				query = uploadQuery(position, state)
+			}
+			if query.Next() {
+				var titles []string
+				titles, position = uploadTitles(query.Resp(), position)
+				if len(titles) == 0 {
+					continue
+				}
+				next := position
+				return titles, func() { savePosition(next, state) }, true
+			}
+			if query.Err() != nil {
+				panic(query.Err())
+			}
+			query = nil
+			select {
+			case <-stop:
+				return nil, nil, false
+			case <-time.After(state.flags.PollInterval):
+			}
+		}
+	}
+}
+
+// Return a query for the uploads logged since the position.
+func uploadQuery(position recentPosition, state *state) *query {
+	params := params.Values{
+		"list":        "logevents",
+		"letype":      "upload",
+		"ledir":       "newer",
+		"lestart":     position.Timestamp,
+		"lenamespace": strconv.Itoa(state.site.fileNamespace),
+		"leprop":      "ids|title|timestamp",
+		"lelimit":     "max",
+	}
+	return newQuery(state.client, params)
+}
+
+// Return the titles of the files uploaded after the position in a page of
+// the upload log, and the position at its end.
+func uploadTitles(resp *jason.Object, position recentPosition) ([]string, recentPosition) {
+	events, err := resp.GetObjectArray("query", "logevents")
+	if err != nil {
+		panic(err)
+	}
+	next := position
+	var titles []string
+	seen := make(map[string]bool)
+	for _, event := range events {
+		logID, err := event.GetInt64("logid")
+		if err != nil {
+			panic(err)
+		}
+		// lestart includes the last upload already processed.
+		if logID <= position.LogID {
+			continue
+		}
+		title, err := event.GetString("title")
+		if err != nil {
+			panic(err)
+		}
+		if next.Timestamp, err = event.GetString("timestamp"); err != nil {
+			panic(err)
+		}
+		next.LogID = logID
+		// A file may be uploaded again soon after.
+		if !seen[title] {
+			titles = append(titles, title)
+			seen[title] = true
+		}
+	}
+	return titles, next
+}
+
+// Save the position reached to the recent file, if there is one.
+func savePosition(position recentPosition, state *state) {
+	if state.flags.RecentFile != "" {
+		if err := writeJSONFile(state.flags.RecentFile, position); err != nil {
+			warn.Print("Can't save position: ", err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessRecent(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	recent := filepath.Join(t.TempDir(), "recent")
+	flags := []string{"--recentfile", recent, "--maxedits", "1", "--pollinterval", "1ms", "--catfilelimit", "0"}
+
+	// Stopping before the uploads so far are processed doesn't save the
+	// position.
+	checkStats(t, runTestCommand(t, wiki, []string{"Recent", "20190101000000"}, flags...).stats, stats{examined: 2, withCamera: 2, inCat: 1, edited: 1})
+	if _, err := os.Stat(recent); !os.IsNotExist(err) {
+		t.Errorf("position saved: %v", err)
+	}
+
+	checkStats(t, runTestCommand(t, wiki, []string{"Recent", "20190101000000"}, flags...).stats, stats{examined: 6, withCamera: 5, warnings: 3, inCat: 2, edited: 1})
+	var position recentPosition
+	if _, err := readJSONFile(recent, &position); err != nil || position.Timestamp != "2019-01-06T00:00:00Z" {
+		t.Errorf("got position %+v, %v", position, err)
+	}
+
+	// The next run continues with new uploads.
+	wiki.addFile("File:G.jpg", "Bob", "20190107000000", "Canon", "Canon EOS 5D", "")
+	checkStats(t, runTestCommand(t, wiki, []string{"Recent"}, flags...).stats, stats{examined: 1, withCamera: 1, edited: 1})
+}
+
+func TestRecentGallery(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	wiki.logLimit = 2
+	wiki.addPage("User:Bot/Warnings", "old")
+	state := runTestCommand(t, wiki, []string{"Recent", "20190101000000"}, "--gallery", "User:Bot/Warnings", "--filelimit", "1", "--maxedits", "2", "--pollinterval", "1ms")
+
+	// The file limit doesn't apply, and the warnings from every page of
+	// the upload log are kept.
+	checkStats(t, state.stats, stats{examined: 6, withCamera: 5, warnings: 3, inCat: 1, edited: 2})
+	if state.flags.FileLimit != 1 {
+		t.Errorf("file limit changed to %d", state.flags.FileLimit)
+	}
+	checkText(t, wiki, "User:Bot/Warnings", "<gallery>\nFile:F.jpg|Added to empty category\nFile:E.jpg|Category:Taken with Foo cameras doesn't exist\nFile:D.jpg|Unknown Thing\n</gallery>")
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	mwclient "cgt.name/pkg/go-mwclient"
+	"cgt.name/pkg/go-mwclient/params"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/antonholmquist/jason"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Request parameters that vary between runs or are secret, and are left out
+// of recordings.
+var volatileParams = map[string]bool{
+	"token":         true,
+	"lgtoken":       true,
+	"lgpassword":    true,
+	"maxlag":        true,
+	"format":        true,
+	"formatversion": true,
+	"utf8":          true,
+	"assert":        true,
+}
+
+// An error returned by the Wiki, in a form that can be saved.
+type recordedError struct {
+	Kind    string `json:"kind"` // "api", "nochange", "busy", "notfound" or "other".
+	Code    string `json:"code,omitempty"`
+	Info    string `json:"info,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// A single request to the Wiki and its result.
+type interaction struct {
+	Method    string            `json:"method"` // "get", "post", "page", "edit" or "login".
+	Params    map[string]string `json:"params"`
+	Response  json.RawMessage   `json:"response,omitempty"`
+	Text      string            `json:"text,omitempty"`
+	Timestamp string            `json:"timestamp,omitempty"`
+	Error     *recordedError    `json:"error,omitempty"`
+}
+
+func saveError(err error) *recordedError {
+	if err == nil {
+		return nil
+	}
+	if apiErr, ok := err.(mwclient.APIError); ok {
+		return &recordedError{Kind: "api", Code: apiErr.Code, Info: apiErr.Info}
+	}
+	switch err {
+	case mwclient.ErrEditNoChange:
+		return &recordedError{Kind: "nochange"}
+	case mwclient.ErrAPIBusy:
+		return &recordedError{Kind: "busy"}
+	case mwclient.ErrPageNotFound:
+		return &recordedError{Kind: "notfound"}
+	}
+	return &recordedError{Kind: "other", Message: err.Error()}
+}
+
+func (e *recordedError) restore() error {
+	if e == nil {
+		return nil
+	}
+	switch e.Kind {
+	case "api":
+		return mwclient.APIError{Code: e.Code, Info: e.Info}
+	case "nochange":
+		return mwclient.ErrEditNoChange
+	case "busy":
+		return mwclient.ErrAPIBusy
+	case "notfound":
+		return mwclient.ErrPageNotFound
+	}
+	return errors.New(e.Message)
+}
+
+// Copy request parameters, leaving out the volatile ones.
+func recordParams(params map[string]string) map[string]string {
+	result := make(map[string]string, len(params))
+	for key, value := range params {
+		if !volatileParams[key] {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// Key used to match a replayed request with a recorded one.
+func interactionKey(method string, params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var builder strings.Builder
+	builder.WriteString(method)
+	for _, key := range keys {
+		builder.WriteString("&" + key + "=" + params[key])
+	}
+	return builder.String()
+}
+
+// A wiki that passes requests to another wiki and records them, for saving
+// as a fixture file.
+type recorder struct {
+	mutex        sync.Mutex
+	client       wiki
+	file         string
+	interactions []interaction
+}
+
+func newRecorder(client wiki, file string) *recorder {
+	return &recorder{client: client, file: file}
+}
+
+func (r *recorder) add(i interaction) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.interactions = append(r.interactions, i)
+}
+
+func (r *recorder) call(method string, p params.Values, call func(params.Values) (*jason.Object, error)) (*jason.Object, error) {
+	saved := recordParams(p)
+	json, err := call(p)
+	i := interaction{Method: method, Params: saved, Error: saveError(err)}
+	if json != nil {
+		i.Response, _ = json.Marshal()
+	}
+	r.add(i)
+	return json, err
+}
+
+func (r *recorder) Get(p params.Values) (*jason.Object, error) {
+	return r.call("get", p, r.client.Get)
+}
+
+func (r *recorder) Post(p params.Values) (*jason.Object, error) {
+	return r.call("post", p, r.client.Post)
+}
+
+func (r *recorder) GetPageByName(title string) (string, string, error) {
+	text, timestamp, err := r.client.GetPageByName(title)
+	r.add(interaction{Method: "page", Params: map[string]string{"title": title}, Text: text, Timestamp: timestamp, Error: saveError(err)})
+	return text, timestamp, err
+}
+
+func (r *recorder) Edit(p params.Values) error {
+	saved := recordParams(p)
+	err := r.client.Edit(p)
+	r.add(interaction{Method: "edit", Params: saved, Error: saveError(err)})
+	return err
+}
+
+func (r *recorder) Login(username, password string) error {
+	return r.recordLogin(r.client.Login, username, password)
+}
+
+// Log in with the given function, recording the result.
+func (r *recorder) recordLogin(login func(username, password string) error, username, password string) error {
+	err := login(username, password)
+	r.add(interaction{Method: "login", Params: map[string]string{"lgname": username}, Error: saveError(err)})
+	return err
+}
+
+func (r *recorder) DumpCookies() []*http.Cookie {
+	return r.client.DumpCookies()
+}
+
+func (r *recorder) LoadCookies(cookies []*http.Cookie) {
+	r.client.LoadCookies(cookies)
+}
+
+// Write the recorded interactions to the fixture file.
+func (r *recorder) save() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	data, err := json.MarshalIndent(r.interactions, "", " ")
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(r.file, data, 0600)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// A wiki that answers requests from a fixture file saved by a recorder.
+// Identical requests are answered in the order they were recorded.
+type replayer struct {
+	mutex   sync.Mutex
+	answers map[string][]interaction
+	cookies []*http.Cookie
+}
+
+func newReplayer(file string) *replayer {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		panic(err)
+	}
+	var interactions []interaction
+	err = json.Unmarshal(data, &interactions)
+	if err != nil {
+		panic(fmt.Sprintf("%v: %v", file, err))
+	}
+	r := &replayer{answers: make(map[string][]interaction)}
+	for _, i := range interactions {
+		key := interactionKey(i.Method, i.Params)
+		r.answers[key] = append(r.answers[key], i)
+	}
+	return r
+}
+
+// Return the next recorded answer for a request.
+func (r *replayer) answer(method string, params map[string]string) (interaction, error) {
+	key := interactionKey(method, recordParams(params))
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	answers := r.answers[key]
+	if len(answers) == 0 {
+		return interaction{}, errors.New("No recorded response for " + key)
+	}
+	r.answers[key] = answers[1:]
+	return answers[0], nil
+}
+
+func (r *replayer) call(method string, p params.Values) (*jason.Object, error) {
+	i, err := r.answer(method, p)
+	if err != nil {
+		return nil, err
+	}
+	var json *jason.Object
+	if i.Response != nil {
+		json, err = jason.NewObjectFromBytes(i.Response)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json, i.Error.restore()
+}
+
+func (r *replayer) Get(p params.Values) (*jason.Object, error) {
+	return r.call("get", p)
+}
+
+func (r *replayer) Post(p params.Values) (*jason.Object, error) {
+	return r.call("post", p)
+}
+
+func (r *replayer) GetPageByName(title string) (string, string, error) {
+	i, err := r.answer("page", map[string]string{"title": title})
+	if err != nil {
+		return "", "", err
+	}
+	return i.Text, i.Timestamp, i.Error.restore()
+}
+
+func (r *replayer) Edit(p params.Values) error {
+	i, err := r.answer("edit", p)
+	if err != nil {
+		return err
+	}
+	return i.Error.restore()
+}
+
+func (r *replayer) Login(username, password string) error {
+	i, err := r.answer("login", map[string]string{"lgname": username})
+	if err != nil {
+		return err
+	}
+	return i.Error.restore()
+}
+
+func (r *replayer) DumpCookies() []*http.Cookie {
+	return r.cookies
+}
+
+func (r *replayer) LoadCookies(cookies []*http.Cookie) {
+	r.cookies = cookies
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	wiki.addPage("User:Bot/Warnings", "")
+	fixture := filepath.Join(t.TempDir(), "fixture.json")
+	recorded := newTestState(t, wiki, "--record", fixture, "--gallery", "User:Bot/Warnings")
+	runCommand([]string{"User:Alice"}, recorded)
+	EndProc(recorded)
+
+	// Replay with the API pointing nowhere.
+	requests := wiki.requests
+	replayed := newTestState(t, wiki, "--replay", fixture, "--gallery", "User:Bot/Warnings", "--api", "http://127.0.0.1:1/w/api.php")
+	runCommand([]string{"User:Alice"}, replayed)
+	if wiki.requests != requests {
+		t.Errorf("replay made %d requests to the Wiki", wiki.requests-requests)
+	}
+	checkStats(t, replayed.stats, recorded.stats)
+}
+
+func TestReplayUnrecorded(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	fixture := filepath.Join(t.TempDir(), "fixture.json")
+	recorded := newTestState(t, wiki, "--record", fixture)
+	runCommand([]string{"File:A.jpg"}, recorded)
+	EndProc(recorded)
+
+	replayed := newTestState(t, wiki, "--replay", fixture)
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic for a request that wasn't recorded")
+		}
+	}()
+	runCommand([]string{"File:B.jpg"}, replayed)
+}
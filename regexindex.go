@@ -0,0 +1,104 @@
+package main
+
+import (
+	"regexp/syntax"
+	"sort"
+)
+
+// An index of the category regexes, used to skip the regexes that can't
+// match a key. Each regex is filed under a trigram from a literal string
+// that every match must contain, and only the regexes whose trigram occurs
+// in the key are tried, in their original order, so that the first match
+// is the same as with applyRegex.
+type regexIndex struct {
+	regexes   []catRegex
+	trigrams  map[string][]int // Trigram -> indexes of regexes, ascending.
+	unindexed []int            // Regexes without a suitable literal.
+}
+
+func newRegexIndex(regexes []catRegex) *regexIndex {
+	index := &regexIndex{regexes: regexes, trigrams: make(map[string][]int)}
+	for i := range regexes {
+		literal := ""
+		if re, err := syntax.Parse(regexes[i].regex.String(), syntax.Perl); err == nil {
+			literal = requiredLiteral(re.Simplify())
+		}
+		if len(literal) < 3 {
+			index.unindexed = append(index.unindexed, i)
+			continue
+		}
+		// Use the least common trigram so far, to keep the lists short.
+		best := literal[:3]
+		for j := 1; j+3 <= len(literal); j++ {
+			if len(index.trigrams[literal[j:j+3]]) < len(index.trigrams[best]) {
+				best = literal[j : j+3]
+			}
+		}
+		index.trigrams[best] = append(index.trigrams[best], i)
+	}
+	return index
+}
+
+// Return the longest literal string that must appear in any match of a
+// regex, or blank if none is found.
+func requiredLiteral(re *syntax.Regexp) string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return ""
+		}
+		return string(re.Rune)
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiteral(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return requiredLiteral(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		longest, run := "", ""
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0 {
+				run += string(sub.Rune)
+			} else {
+				run = ""
+				if literal := requiredLiteral(sub); len(literal) > len(longest) {
+					longest = literal
+				}
+			}
+			if len(run) > len(longest) {
+				longest = run
+			}
+		}
+		return longest
+	}
+	return ""
+}
+
+// Return the target of the first regex that matches the key, or blank.
+func (index *regexIndex) match(key string) string {
+	candidates := index.unindexed
+	merged := false
+	for i := 0; i+3 <= len(key); i++ {
+		if list := index.trigrams[key[i:i+3]]; len(list) > 0 {
+			if !merged {
+				candidates = append([]int(nil), candidates...)
+				merged = true
+			}
+			candidates = append(candidates, list...)
+		}
+	}
+	if merged {
+		sort.Ints(candidates)
+	}
+	last := -1
+	for _, i := range candidates {
+		if i == last {
+			continue
+		}
+		last = i
+		if index.regexes[i].regex.MatchString(key) {
+			return index.regexes[i].target
+		}
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"testing"
+)
+
+// The keys of the embedded catmapping in sorted order, so that the same
+// subsets are tested on every run.
+func sortedMappingKeys(t testing.TB) ([]string, map[string]string) {
+	categoryMap := loadTestMappings(t, flags{}).get().categoryMap
+	keys := make([]string, 0, len(categoryMap))
+	for key := range categoryMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, categoryMap
+}
+
+// Every nth key from the embedded catmapping, which mostly don't match a
+// regex, and keys that do.
+func testRegexKeys(t testing.TB, n int) []string {
+	mappingKeys, _ := sortedMappingKeys(t)
+	keys := []string{
+		"Hipstamatic 123",
+		"Phase OneLeaf Aptus 22(1234)",
+		"Eagle 2 CamHRIS",
+		"FUJI PHOTO FILM CO., LTD.SP-2500-1234567",
+		"iptc-uniqueobjectname replicated in model tag, etc.",
+		"",
+		"ab",
+	}
+	for i := 0; i < len(mappingKeys); i += n {
+		keys = append(keys, mappingKeys[i], mappingKeys[i]+"Hipstamatic")
+	}
+	return keys
+}
+
+// Regexes from the embedded catregex, followed by many more made from
+// catmapping entries, as if they had been converted to regex form.
+func testRegexes(t testing.TB, extra int) []catRegex {
+	mappings := loadTestMappings(t, flags{})
+	regexes := append([]catRegex(nil), mappings.get().catRegex...)
+	keys, categoryMap := sortedMappingKeys(t)
+	for _, key := range keys[:extra] {
+		regexes = append(regexes, catRegex{regexp.MustCompile(regexp.QuoteMeta(key) + `(-\d+)?$`), categoryMap[key]})
+	}
+	return regexes
+}
+
+func TestRegexIndexMatchesApplyRegex(t *testing.T) {
+	regexes := testRegexes(t, 2000)
+	regexes = append(regexes,
+		catRegex{regexp.MustCompile(`(?i)canon`), "Case-insensitive"},
+		catRegex{regexp.MustCompile(`Can|Nik`), "Alternation"},
+		catRegex{regexp.MustCompile(`.*`), "Anything"})
+	index := newRegexIndex(regexes)
+	// Fewer keys are checked when the tests are run with -short.
+	n := 8
+	if testing.Short() {
+		n = 64
+	}
+	for _, key := range testRegexKeys(t, n) {
+		if got, want := index.match(key), applyRegex(key, regexes); got != want {
+			t.Errorf("%q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestRequiredLiteral(t *testing.T) {
+	tests := map[string]string{
+		`.*Leaf Aptus 22\(.*`:  "Leaf Aptus 22(",
+		`Hipstamatic.*`:        "Hipstamatic",
+		`a(bcd)+e`:             "bcd",
+		`x?Model \d\d(-Long)?`: "Model ",
+		`(?i)canon`:            "",
+		`Can|Nik`:              "",
+	}
+	for pattern, want := range tests {
+		re, err := syntax.Parse(pattern, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := requiredLiteral(re.Simplify()); got != want {
+			t.Errorf("%s: got %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+func BenchmarkApplyRegex(b *testing.B) {
+	regexes := testRegexes(b, 2000)
+	keys := testRegexKeys(b, 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		applyRegex(keys[i%len(keys)], regexes)
+	}
+}
+
+func BenchmarkRegexIndex(b *testing.B) {
+	index := newRegexIndex(testRegexes(b, 2000))
+	keys := testRegexKeys(b, 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index.match(keys[i%len(keys)])
+	}
+}
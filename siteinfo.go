@@ -0,0 +1,137 @@
+package main
+
+import (
+	"cgt.name/pkg/go-mwclient/params"
+	"github.com/antonholmquist/jason"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Namespace ID of categories in MediaWiki.
+const categoryNamespace = 14
+
+// Configuration of the Wiki being processed.
+type site struct {
+	fileNamespace    int      // Namespace ID of file pages.
+	filePrefixes     []string // All prefixes of the file namespace, e.g., "File:", "Image:".
+	categoryPrefix   string   // Prefix used for categories, e.g., "Category:".
+	categoryPrefixes []string // All prefixes of the category namespace.
+	targetPrefix     string   // Prepended to mapping file targets, e.g., "Taken with ".
+	scannerPrefix    string   // Prefix of scanner categories, e.g., "Scanned with ".
+}
+
+// Return the names and aliases of a namespace from a siteinfo response,
+// with the local name first.
+func namespaceNames(json *jason.Object, id int) []string {
+	names := make([]string, 0, 4)
+	add := func(name string) {
+		if name == "" {
+			return
+		}
+		for _, n := range names {
+			if n == name {
+				return
+			}
+		}
+		names = append(names, name)
+	}
+	ns, err := json.GetObject("query", "namespaces", strconv.Itoa(id))
+	if err != nil {
+		panic("Namespace " + strconv.Itoa(id) + " not found on Wiki")
+	}
+	name, _ := ns.GetString("name")
+	add(name)
+	canonical, _ := ns.GetString("canonical")
+	add(canonical)
+	aliases, err := json.GetObjectArray("query", "namespacealiases")
+	if err == nil {
+		for _, alias := range aliases {
+			aliasID, err := alias.GetInt64("id")
+			if err != nil || int(aliasID) != id {
+				continue
+			}
+			name, _ := alias.GetString("alias")
+			add(name)
+		}
+	}
+	return names
+}
+
+// Fetch the localised namespace names from the Wiki. categoryPrefix,
+// if not blank, overrides the local name of the category namespace.
+func newSite(client wiki, fileNamespace int, categoryPrefix string, targetPrefix string, scannerPrefix string) *site {
+	params := params.Values{
+		"action":   "query",
+		"meta":     "siteinfo",
+		"siprop":   "namespaces|namespacealiases",
+		"continue": "",
+	}
+	json, err := client.Get(params)
+	if err != nil {
+		panic(err)
+	}
+	var s site
+	s.fileNamespace = fileNamespace
+	for _, name := range namespaceNames(json, fileNamespace) {
+		s.filePrefixes = append(s.filePrefixes, name+":")
+	}
+	for _, name := range namespaceNames(json, categoryNamespace) {
+		s.categoryPrefixes = append(s.categoryPrefixes, name+":")
+	}
+	if categoryPrefix != "" {
+		s.categoryPrefix = categoryPrefix
+		s.categoryPrefixes = append(s.categoryPrefixes, categoryPrefix)
+	} else {
+		s.categoryPrefix = s.categoryPrefixes[0]
+	}
+	s.targetPrefix = targetPrefix
+	s.scannerPrefix = scannerPrefix
+	return &s
+}
+
+// Return the title without its namespace prefix if it has one of the given
+// prefixes, and whether a prefix was found. Namespace names are
+// case-insensitive.
+func trimNamespace(title string, prefixes []string) (string, bool) {
+	for _, prefix := range prefixes {
+		if len(title) >= len(prefix) && strings.EqualFold(title[:len(prefix)], prefix) {
+			return title[len(prefix):], true
+		}
+	}
+	return title, false
+}
+
+// Return true if a title is in the file namespace.
+func (s *site) isFile(title string) bool {
+	_, found := trimNamespace(title, s.filePrefixes)
+	return found
+}
+
+// Return true if a title is in the category namespace.
+func (s *site) isCategory(title string) bool {
+	_, found := trimNamespace(title, s.categoryPrefixes)
+	return found
+}
+
+// Return the category for a mapping target without a category prefix,
+// e.g., "Category:Taken with Canon EOS 5D".
+func (s *site) target(name string) string {
+	return s.categoryPrefix + s.targetPrefix + name
+}
+
+// Return a category title using the Wiki's prefix for categories.
+func (s *site) category(name string) string {
+	name, _ = trimNamespace(name, s.categoryPrefixes)
+	return s.categoryPrefix + name
+}
+
+// Return a regular expression that matches any of the category namespace
+// prefixes, including the colon.
+func (s *site) categoryRegex() string {
+	names := make([]string, len(s.categoryPrefixes))
+	for i := range s.categoryPrefixes {
+		names[i] = regexp.QuoteMeta(s.categoryPrefixes[i])
+	}
+	return "(?i:" + strings.Join(names, "|") + ")"
+}
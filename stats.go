@@ -11,6 +11,7 @@ type stats struct {
 	warnings   int32 // Number of files with a warning printed to output
 	inCat      int32 // Number of files already in a relevant category.
 	populated  int32 // Number of files skipped because of catFileLimit.
+	handled    int32 // Number of files skipped because they were handled in an earlier run.
 	edited     int32 // Number of files edited.
 }
 
@@ -18,6 +19,7 @@ func (s stats) print() {
 	fmt.Println("Total files examined: ", s.examined)
 	fmt.Println("Files with camera details in Exif: ", s.withCamera)
 	fmt.Println("Files skipped due to CatFileLimit: ", s.populated)
+	fmt.Println("Files handled in earlier runs: ", s.handled)
 	fmt.Println("Files with warnings printed: ", s.warnings)
 	fmt.Println("Files already categorised: ", s.inCat)
 	fmt.Println("Files edited: ", s.edited)
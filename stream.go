@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/antonholmquist/jason"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time to wait before reconnecting to an event stream, unless the server
+// sets it with a retry field.
+const sseDefaultRetry = 3 * time.Second
+
+// An event received from a server-sent event stream.
+type sseEvent struct {
+	id    string // Last event ID seen, sent again on reconnecting.
+	event string // Event type, "message" if not given.
+	data  string
+}
+
+// Client for a server-sent event stream, e.g., Wikimedia EventStreams.
+type sseClient struct {
+	url       string
+	userAgent string
+	http      *http.Client
+	lastID    string
+	retry     time.Duration
+}
+
+func newSSEClient(url string, userAgent string) *sseClient {
+	return &sseClient{
+		url:       url,
+		userAgent: userAgent,
+		http:      &http.Client{}, // No timeout: the response never ends.
+		retry:     sseDefaultRetry,
+	}
+}
+
+// Send events to the channel until stop is closed. Reconnects when the
+// connection fails or is closed, asking for the events after the last one
+// received.
+func (c *sseClient) run(events chan<- sseEvent, stop <-chan struct{}) {
+	for {
+		err := c.connect(events, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		warn.Print("Event stream: ", err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(c.retry):
+		}
+	}
+}
+
+// Read events from one connection. Always returns an error, since the
+// stream is only expected to end when stop is closed.
+func (c *sseClient) connect(events chan<- sseEvent, stop <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req, err := http.NewRequest("GET", c.url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("User-Agent", c.userAgent)
+	if c.lastID != "" {
+		req.Header.Set("Last-Event-ID", c.lastID)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", c.url, resp.Status)
+	}
+	if err := c.read(resp.Body, events, stop); err != nil {
+		return err
+	}
+	return errors.New("connection closed")
+}
+
+// Parse the stream, sending each complete event to the channel.
+func (c *sseClient) read(body io.Reader, events chan<- sseEvent, stop <-chan struct{}) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var event sseEvent
+	var data []string
+	id := c.lastID
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			// A blank line ends the event. Events without data are ignored.
+			if data != nil {
+				c.lastID = id
+				event.id = id
+				event.data = strings.Join(data, "\n")
+				if event.event == "" {
+					event.event = "message"
+				}
+				select {
+				case events <- event:
+				case <-stop:
+					return nil
+				}
+			}
+			event = sseEvent{}
+			data = nil
+			continue
+		}
+		if line[0] == ':' {
+			continue // comment, e.g., a keepalive.
+		}
+		field, value := line, ""
+		if pos := strings.Index(line, ":"); pos >= 0 {
+			field = line[:pos]
+			value = strings.TrimPrefix(line[pos+1:], " ")
+		}
+		switch field {
+		case "event":
+			event.event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			if !strings.Contains(value, "\x00") {
+				id = value
+			}
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil {
+				c.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// Return the title of the file page created by an upload from a
+// page-create event, and whether the event was for a file page on the wiki
+// with the given domain. Events without a domain are accepted.
+func streamTitle(event sseEvent, domain string, site *site) (string, bool) {
+	if event.event != "message" {
+		return "", false
+	}
+	json, err := jason.NewObjectFromBytes([]byte(event.data))
+	if err != nil {
+		warn.Print("Event stream: ", err)
+		return "", false
+	}
+	if eventDomain, err := json.GetString("meta", "domain"); err == nil && eventDomain != domain {
+		return "", false
+	}
+	namespace, err := json.GetInt64("page_namespace")
+	if err != nil || int(namespace) != site.fileNamespace {
+		return "", false
+	}
+	if redirect, _ := json.GetBoolean("page_is_redirect"); redirect {
+		return "", false
+	}
+	title, err := json.GetString("page_title")
+	if err != nil {
+		return "", false
+	}
+	// Titles in events use underscores, and may lack the namespace prefix.
+	title = strings.Replace(title, "_", " ", -1)
+	if !site.isFile(title) {
+		title = site.filePrefixes[0] + title
+	}
+	return title, true
+}
+
+// Process new file pages from the event stream as they are created,
+// with one warning gallery and set of category counts for the whole run.
+// Runs until a limit other than FileLimit stops processing.
+func processStream(state *state) {
+	api, err := url.Parse(state.flags.API)
+	if err != nil {
+		panic(err)
+	}
+	client := newSSEClient(state.flags.StreamURL, "takenwith "+state.flags.Operator)
+	events := make(chan sseEvent, state.flags.BatchSize)
+	stop := make(chan struct{})
+	defer close(stop)
+	go client.run(events, stop)
+	// Following uploads doesn't end, so FileLimit doesn't apply.
+	processSource(streamSource(events, api.Host, state), 0, state)
+}
+
+// Return a source of the titles of the file pages created on the wiki with
+// the given domain, from page-create events. Titles are collected into
+// batches of BatchSize, and a smaller batch is returned when PollInterval
+// passes without filling it.
+func streamSource(events <-chan sseEvent, domain string, state *state) titleSource {
+	return func(stop <-chan struct{}) ([]string, func(), bool) {
+		var titles []string
+		seen := make(map[string]bool)
+		ticker := time.NewTicker(state.flags.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return nil, nil, false
+			case event := <-events:
+				title, ok := streamTitle(event, domain, state.site)
+				if !ok || seen[title] {
+					continue
+				}
+				titles = append(titles, title)
+				seen[title] = true
+				if len(titles) >= state.flags.BatchSize {
+					return titles, nil, true
+				}
+			case <-ticker.C:
+				if len(titles) > 0 {
+					return titles, nil, true
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSERead(t *testing.T) {
+	body := strings.Join([]string{
+		": keepalive",
+		"retry: 500",
+		"id: 1",
+		"data: one",
+		"",
+		"event: other",
+		"data: two",
+		"data:three",
+		"",
+		"id: 2",
+		"",
+		"id: 3",
+		"data",
+		"",
+		"id: 4",
+		"data: unfinished",
+	}, "\n")
+	client := newSSEClient("", "")
+	client.lastID = "0"
+	events := make(chan sseEvent, 10)
+	if err := client.read(strings.NewReader(body), events, nil); err != nil {
+		t.Fatal(err)
+	}
+	close(events)
+	var got []sseEvent
+	for event := range events {
+		got = append(got, event)
+	}
+
+	// Events without data aren't sent, and the ID of an event is kept for
+	// later ones that don't set it.
+	want := []sseEvent{
+		{"1", "message", "one"},
+		{"1", "other", "two\nthree"},
+		{"3", "message", ""},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got events %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+	// The last event ID only changes when an event is dispatched.
+	if client.lastID != "3" {
+		t.Errorf("got last ID %q, want 3", client.lastID)
+	}
+	if client.retry != 500*time.Millisecond {
+		t.Errorf("got retry %v", client.retry)
+	}
+}
+
+func TestSSEReadStop(t *testing.T) {
+	client := newSSEClient("", "")
+	stop := make(chan struct{})
+	close(stop)
+	if err := client.read(strings.NewReader("id: 1\ndata: x\n\n"), make(chan sseEvent), stop); err != nil {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestStreamTitle(t *testing.T) {
+	tests := []struct {
+		event sseEvent
+		want  string // Blank if not accepted.
+	}{
+		{sseEvent{"", "message", fakeCreateEvent("example.org", 6, "File:A_b.jpg", false)}, "File:A b.jpg"},
+		{sseEvent{"", "message", fakeCreateEvent("example.org", 6, "A.jpg", false)}, "File:A.jpg"},
+		{sseEvent{"", "message", `{"page_namespace":6,"page_title":"A.jpg"}`}, "File:A.jpg"},
+		{sseEvent{"", "message", fakeCreateEvent("other.example.org", 6, "A.jpg", false)}, ""},
+		{sseEvent{"", "message", fakeCreateEvent("example.org", 0, "Main_Page", false)}, ""},
+		{sseEvent{"", "message", fakeCreateEvent("example.org", 6, "File:Old.jpg", true)}, ""},
+		{sseEvent{"", "error", fakeCreateEvent("example.org", 6, "A.jpg", false)}, ""},
+		{sseEvent{"", "message", "not JSON"}, ""},
+	}
+	for _, test := range tests {
+		got, ok := streamTitle(test.event, "example.org", testSite)
+		if got != test.want || ok != (test.want != "") {
+			t.Errorf("%q: got %q, %v, want %q", test.event.data, got, ok, test.want)
+		}
+	}
+}
+
+func TestProcessStream(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	domain := strings.TrimPrefix(wiki.server.URL, "http://")
+	stream := newFakeStream(t, 2,
+		fakeCreateEvent("other.example.org", 6, "File:F.jpg", false),
+		fakeCreateEvent(domain, 0, "Main_Page", false),
+		fakeCreateEvent(domain, 6, "File:Old_name.jpg", true),
+		fakeCreateEvent(domain, 6, "C.jpg", false),
+		fakeCreateEvent(domain, 6, "File:B.jpg", false),
+		fakeCreateEvent(domain, 6, "A.jpg", false),
+		fakeCreateEvent(domain, 6, "File:F.jpg", false),
+	)
+	state := runTestCommand(t, wiki, []string{"Stream"}, "--streamurl", stream.server.URL, "--maxedits", "1", "--pollinterval", "1h")
+
+	// Only the file pages on this wiki are processed, in batches, and the
+	// stream continues after each event received.
+	if got := wiki.editedTitles(); len(got) != 1 || got[0] != "File:A.jpg" {
+		t.Errorf("got edits %v", got)
+	}
+	if got := state.stats.examined; got != 4 {
+		t.Errorf("examined %d files, want 4", got)
+	}
+	got := stream.connections()
+	if want := []string{"", "2", "4", "6"}; len(got) < len(want) || strings.Join(got[:len(want)], ",") != strings.Join(want, ",") {
+		t.Errorf("got Last-Event-IDs %q, want %q", got, want)
+	}
+}
+
+func TestStreamGallery(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	wiki.addPage("User:Bot/Warnings", "old")
+	domain := strings.TrimPrefix(wiki.server.URL, "http://")
+	var events []string
+	for _, title := range []string{"D.jpg", "C.jpg", "E.jpg", "B.jpg", "A.jpg"} {
+		events = append(events, fakeCreateEvent(domain, 6, title, false))
+	}
+	stream := newFakeStream(t, len(events), events...)
+	state := runTestCommand(t, wiki, []string{"Stream"}, "--streamurl", stream.server.URL, "--gallery", "User:Bot/Warnings", "--filelimit", "1", "--maxedits", "1", "--pollinterval", "10ms")
+
+	// The file limit doesn't apply, and the warnings from every batch are
+	// kept.
+	checkStats(t, state.stats, stats{examined: 5, withCamera: 4, warnings: 2, inCat: 1, edited: 1})
+	if state.flags.FileLimit != 1 {
+		t.Errorf("file limit changed to %d", state.flags.FileLimit)
+	}
+	checkText(t, wiki, "User:Bot/Warnings", "<gallery>\nFile:E.jpg|Category:Taken with Foo cameras doesn't exist\nFile:D.jpg|Unknown Thing\n</gallery>")
+}
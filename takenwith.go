@@ -3,29 +3,39 @@ package main
 import (
 	mwclient "cgt.name/pkg/go-mwclient"
 	"cgt.name/pkg/go-mwclient/params"
+	"errors"
 	"fmt"
 	"github.com/antonholmquist/jason"
 	"github.com/garyhouston/takenwith/mwlib"
 	goflags "github.com/jessevdk/go-flags"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // "global" exectution state.
 type state struct {
-	client        *mwclient.Client
+	client        wiki
 	flags         flags
 	verbose       log.Logger
-	categoryMap   map[string]string
-	allCategories map[string]bool
-	catRegex      []catRegex
+	mappings      *mappingFiles
+	processed     *processedCache
+	catCountCache *catCountCache
+	cookies       *mwlib.CookieAttributes // Attributes of the cookies set by the Wiki.
+	oldCookies    []*http.Cookie          // Cookies loaded without attributes.
+	titleLimit    int                     // Maximum number of titles in one query.
 	stats         stats
-	lastEdit      time.Time
+	editor        *editor
+	site          *site
 }
 
 // strings.ToLower would convert all Unicode characters to lower case,
@@ -44,8 +54,9 @@ func asciiToLower(s string) string {
 // insertPos finds a position in a page to insert a category: a) after
 // the last existing category, ignoring categories in unparsed
 // sections (HTML comments, <pre> etc.) b) before an unterminated
-// unparsed section c) at the end of the page.
-func insertPos(page string) int {
+// unparsed section c) at the end of the page. categoryRegex matches the
+// category namespace prefixes.
+func insertPos(page string, categoryRegex string) int {
 	// Assume that unparsed sections don't nest, but don't assume
 	// that a matching end tag is present.
 	page = asciiToLower(page) // Ignore case when matching tags and "category".
@@ -76,10 +87,10 @@ func insertPos(page string) int {
 		}
 		page = page[:start] + strings.Repeat(" ", end-start) + page[end:]
 		if !unterminated {
-			insertPos(page)
+			insertPos(page, categoryRegex)
 		}
 	}
-	regexp := regexp.MustCompile("\\[\\[category\\:[^]]*\\]\\]")
+	regexp := regexp.MustCompile("\\[\\[" + categoryRegex + "[^]]*\\]\\]")
 	matches := regexp.FindAllIndex([]byte(page), -1)
 	if len(matches) > 0 {
 		return matches[len(matches)-1][1] // end position of the last match.
@@ -90,12 +101,7 @@ func insertPos(page string) int {
 	return len(page)
 }
 
-func addCategory(page string, category string, remove string, client *mwclient.Client, lastEdit *time.Time) error {
-	// Don't attempt to edit more than once per 5 seconds, per Commons bot policy
-	dur := time.Since(*lastEdit)
-	if dur.Seconds() < 5 {
-		time.Sleep(time.Duration(5)*time.Second - dur)
-	}
+func addCategory(page string, category string, remove string, site *site, client wiki, editor *editor) error {
 	// There's a small chance that saving a page may fail due to
 	// an edit conflict or other transient error. Try up to 3
 	// times before giving up.
@@ -110,13 +116,13 @@ func addCategory(page string, category string, remove string, client *mwclient.C
 		summary := ""
 		if remove != "" {
 			// Remove a category.
-			regexp := regexp.MustCompile("\\n?\\[\\[[Cc]ategory\\:" + remove + "\\]\\]")
+			regexp := regexp.MustCompile("\\n?\\[\\[" + site.categoryRegex() + remove + "\\]\\]")
 			text = string(regexp.ReplaceAll([]byte(text), []byte("")))
-			summary = "moved from [[Category:" + remove + "]] to [[" + category + "]]"
+			summary = "moved from [[" + site.categoryPrefix + remove + "]] to [[" + category + "]]"
 		} else {
 			summary = "added [[" + category + "]]"
 		}
-		pos := insertPos(text)
+		pos := insertPos(text, site.categoryRegex())
 		text = text[0:pos] + "\n[[" + category + "]]" + text[pos:]
 		editcfg := map[string]string{
 			"action":        "edit",
@@ -127,55 +133,59 @@ func addCategory(page string, category string, remove string, client *mwclient.C
 			"bot":           "",
 			"basetimestamp": timestamp,
 		}
-		saveError = client.Edit(editcfg)
+		saveError = editor.edit(editcfg, true)
 		if saveError == nil {
 			break
 		}
-		if strings.Contains(saveError.Error(), "protected") {
+		if saveError == errEditCap || saveError == errNoSession || strings.Contains(saveError.Error(), "protected") {
 			return saveError
 		}
 	}
 	if saveError != nil {
 		panic(fmt.Sprintf("Failed to save %v %v", page, saveError))
 	}
-	*lastEdit = time.Now()
 	return nil
 }
 
-func incCatCount(category string, catCounts map[string]int32) {
-	catCounts[category] = catCounts[category] + 1
-}
-
-func addCategories(files []fileData, catCounts map[string]int32, state *state) {
+func addCategories(files []fileData, catCounts *catCounts, state *state) {
 	for i := range files {
 		if files[i].processed {
 			continue
 		}
+		if state.editor.limiter.capReached() {
+			// Leave the rest of the files unprocessed.
+			return
+		}
 		// The cat size limit needs to be checked again, since adding
 		// previous files in the batch may have pushed it over the
 		// limit.
-		if state.flags.CatFileLimit > 0 && catCounts[files[i].catMapped] >= state.flags.CatFileLimit {
-			state.stats.populated++
+		count, _ := catCounts.get(files[i].catMapped)
+		if state.flags.CatFileLimit > 0 && count >= state.flags.CatFileLimit {
+			atomic.AddInt32(&state.stats.populated, 1)
 			state.verbose.Print(files[i].title, "\n", "Already populated: ", files[i].catMapped)
 		} else {
 			// Identifying emtpy categories helps identify
 			// when we are adding a file to a redirect page
 			// for a renamed category.
-			if catCounts[files[i].catMapped] == 0 {
+			if count == 0 {
 				warn.Print(files[i].title, "\n", "Adding to empty ", files[i].catMapped)
 				files[i].warning = "Added to empty category"
-				state.stats.warnings++
+				atomic.AddInt32(&state.stats.warnings, 1)
 			} else {
-				state.verbose.Printf("%s\nAdding to %s (%d files)", files[i].title, files[i].catMapped, int(catCounts[files[i].catMapped]))
+				state.verbose.Printf("%s\nAdding to %s (%d files)", files[i].title, files[i].catMapped, int(count))
+			}
+			err := addCategory(files[i].title, files[i].catMapped, state.flags.Remove, state.site, state.client, state.editor)
+			if err == errEditCap || err == errNoSession {
+				return
 			}
-			err := addCategory(files[i].title, files[i].catMapped, state.flags.Remove, state.client, &state.lastEdit)
 			if err == nil {
-				state.stats.edited++
-				incCatCount(files[i].catMapped, catCounts)
+				atomic.AddInt32(&state.stats.edited, 1)
+				catCounts.inc(files[i].catMapped)
+				files[i].handled = true
 			} else {
 				warn.Print(files[i].title, "\n", err.Error(), "\n")
 				files[i].warning = err.Error()
-				state.stats.warnings++
+				atomic.AddInt32(&state.stats.warnings, 1)
 			}
 		}
 		files[i].processed = true
@@ -184,14 +194,13 @@ func addCategories(files []fileData, catCounts map[string]int32, state *state) {
 
 // For each file, cache the file count for its category if we don't already
 // have it.
-func cacheCatCounts(files []fileData, client *mwclient.Client, catCounts map[string]int32) {
+func cacheCatCounts(files []fileData, client wiki, titleLimit int, catCounts *catCounts) {
 	// Identify categories where the size isn't already cached. Use a map
 	// to combine duplicates.
 	lookup := make(map[string]bool)
 	for i := range files {
 		if !files[i].processed && files[i].catMapped != "" {
-			_, found := catCounts[files[i].catMapped]
-			if !found {
+			if catCounts.needed(files[i].catMapped) {
 				lookup[files[i].catMapped] = true
 			}
 		}
@@ -204,28 +213,34 @@ func cacheCatCounts(files []fileData, client *mwclient.Client, catCounts map[str
 			cats[idx] = key
 			idx++
 		}
-		files, counts := catNumFiles(cats, client)
+		sort.Strings(cats) // Make requests repeatable.
+		files, counts := catNumFiles(cats, client, titleLimit)
+		exists := make(map[string]bool)
 		for i := range files {
-			catCounts[files[i]] = counts[i]
+			catCounts.add(files[i], counts[i])
+			exists[files[i]] = true
+		}
+		for _, cat := range cats {
+			if !exists[cat] {
+				catCounts.addMissing(cat)
+			}
 		}
 	}
 }
 
 // Process files where the category is missing or already populated.
-func filterCatLimit(files []fileData, client *mwclient.Client, verbose *log.Logger, catFileLimit int32, catCounts map[string]int32, stats *stats) {
+func filterCatLimit(files []fileData, client wiki, catFileLimit int32, catCounts *catCounts) {
 	for i := range files {
 		if !files[i].processed && files[i].catMapped != "" {
-			count, found := catCounts[files[i].catMapped]
+			count, found := catCounts.get(files[i].catMapped)
 			if !found {
-				warn.Print(files[i].title, "\n", "Mapped category doesn't exist: ", files[i].catMapped)
-				files[i].warning = files[i].catMapped + " doesn't exist"
-				stats.warnings++
+				files[i].warn(files[i].catMapped+" doesn't exist", files[i].title, "\n", "Mapped category doesn't exist: ", files[i].catMapped)
 				files[i].processed = true
 				continue
 			}
 			if catFileLimit > 0 && count >= catFileLimit {
-				stats.populated++
-				verbose.Print(files[i].title, "\n", "Already populated: ", files[i].catMapped)
+				files[i].outcome = outcomePopulated
+				files[i].note(files[i].title, "\n", "Already populated: ", files[i].catMapped)
 				files[i].processed = true
 				continue
 			}
@@ -236,27 +251,25 @@ func filterCatLimit(files []fileData, client *mwclient.Client, verbose *log.Logg
 // Determine if any of cats (a file's current categories) match either the
 // Exif target category, any known target category, or any unknown category
 // that's named like a target category.
-func matchCategories(file *fileData, cats []string, mapped string, verbose *log.Logger, ignoreCurrentCats bool, allCategories map[string]bool, stats *stats) bool {
+func matchCategories(file *fileData, cats []string, mapped string, ignoreCurrentCats bool, allCategories map[string]bool, site *site) bool {
 	result := false
 	for _, cat := range cats {
 		if mapped == cat {
-			stats.inCat++
-			verbose.Print(file.title, "\n", "Already in mapped: ", mapped)
+			file.outcome = outcomeInCat
+			file.note(file.title, "\n", "Already in mapped: ", mapped)
 			result = true
 			break
 		}
 		if !ignoreCurrentCats {
 			if allCategories[cat] {
 				result = true
-				stats.inCat++
-				verbose.Print(file.title, "\n", "Already in known: ", cat)
+				file.outcome = outcomeInCat
+				file.note(file.title, "\n", "Already in known: ", cat)
 				break
 			}
-			if strings.HasPrefix(cat, "Category:Taken with ") || strings.HasPrefix(cat, "Category:Scanned with ") {
+			if (site.targetPrefix != "" && strings.HasPrefix(cat, site.categoryPrefix+site.targetPrefix)) || (site.scannerPrefix != "" && strings.HasPrefix(cat, site.categoryPrefix+site.scannerPrefix)) {
 				result = true
-				warn.Print(file.title, "\n", "Already in unknown: ", cat)
-				file.warning = "In unknown " + cat
-				stats.warnings++
+				file.warn("In unknown "+cat, file.title, "\n", "Already in unknown: ", cat)
 				break
 			}
 		}
@@ -265,7 +278,7 @@ func matchCategories(file *fileData, cats []string, mapped string, verbose *log.
 }
 
 // Process files which are already in a relevant category.
-func filterCategories(files []fileData, client *mwclient.Client, verbose *log.Logger, ignoreCurrentCats bool, allCategories map[string]bool, stats *stats) {
+func filterCategories(files []fileData, client wiki, titleLimit int, ignoreCurrentCats bool, allCategories map[string]bool, site *site) {
 	titles := make([]string, len(files))
 	idx := 0
 	for i := range files {
@@ -278,28 +291,29 @@ func filterCategories(files []fileData, client *mwclient.Client, verbose *log.Lo
 		return
 	}
 	titles = titles[0:idx]
-	fileCats := getPageCategories(titles, client)
+	fileCats := getPageCategories(titles, client, titleLimit)
 	for i := range files {
 		if files[i].processed {
 			continue
 		}
 		cats := fileCats[files[i].title]
-		if matchCategories(&files[i], cats, files[i].catMapped, verbose, ignoreCurrentCats, allCategories, stats) {
+		if matchCategories(&files[i], cats, files[i].catMapped, ignoreCurrentCats, allCategories, site) {
 			files[i].processed = true
+			files[i].handled = files[i].warning == ""
 		} else {
 			if files[i].catMapped == "" {
 				// Handle the delayed error case from
 				// mapCategories, now that we know it's not in
 				// a relevant category.
-				warn.Printf("%s\nNo category for %v,%v", files[i].title, files[i].make, files[i].model)
-				files[i].warning = files[i].make + " " + files[i].model
-				stats.warnings++
+				files[i].warn(files[i].make+" "+files[i].model, files[i].title, "\n", "No category for ", files[i].make, ",", files[i].model)
 				files[i].processed = true
 			}
 		}
 	}
 }
 
+// Return the target of the first regex that matches the key, trying each in
+// turn. Lookups use a regexIndex instead, which gives the same result.
 func applyRegex(key string, catRegex []catRegex) string {
 	for i := range catRegex {
 		loc := catRegex[i].regex.FindStringIndex(key)
@@ -311,7 +325,7 @@ func applyRegex(key string, catRegex []catRegex) string {
 }
 
 // Determine Commons category from imageinfo (Exif) data, if possible.
-func mapCategories(files []fileData, state *state) {
+func mapCategories(files []fileData, mappings *mappings, state *state) {
 	for i := range files {
 		var err error
 		files[i].title, err = files[i].pageObj.GetString("title")
@@ -320,9 +334,7 @@ func mapCategories(files []fileData, state *state) {
 		}
 		missing, err := files[i].pageObj.GetBoolean("missing")
 		if err == nil && missing {
-			warn.Print(files[i].title, "\n", "File not found; may have been deleted.\n")
-			files[i].warning = "File not found"
-			state.stats.warnings++
+			files[i].warn("File not found", files[i].title, "\n", "File not found; may have been deleted.\n")
 			files[i].processed = true
 			continue
 		}
@@ -331,11 +343,10 @@ func mapCategories(files []fileData, state *state) {
 			files[i].make, files[i].model = extractCamera(imageinfo[0])
 		}
 		if err != nil || (files[i].make == "" && files[i].model == "") {
-			state.verbose.Print(files[i].title, "\n", "No camera details in Exif")
+			files[i].note(files[i].title, "\n", "No camera details in Exif")
 			files[i].processed = true
 			continue
 		}
-		state.stats.withCamera++
 		// Category mapping: first try the simple map for an exact
 		// match (which is fast), when try each regex match in turn.
 		// If mapping fails, processing continues with blank catMapped
@@ -343,25 +354,66 @@ func mapCategories(files []fileData, state *state) {
 		// warning.
 		key := files[i].make + files[i].model
 		var found bool
-		files[i].catMapped, found = state.categoryMap[key]
+		files[i].catMapped, found = mappings.categoryMap[key]
 		if !found {
-			files[i].catMapped = applyRegex(key, state.catRegex)
+			files[i].catMapped = mappings.regexIndex.match(key)
 		}
 
-		if files[i].catMapped == "Category:CanonS100 (special case)" {
-			files[i].catMapped = mapCanonS100(imageinfo)
-		} else if files[i].catMapped == "Category:CanonS110 (special case)" {
-			files[i].catMapped = mapCanonS110(imageinfo)
+		files[i].catMapped = mapSpecialCase(files[i].catMapped, imageinfo, state.site)
+		files[i].sha1, _ = imageinfo[0].GetString("sha1")
+		if state.processed.handled(files[i].title, files[i].sha1, files[i].catMapped) {
+			files[i].outcome = outcomeHandled
+			files[i].note(files[i].title, "\n", "Handled in an earlier run")
+			files[i].processed = true
+		}
+	}
+}
+
+// Do the read-only part of processing: determine the target category for
+// each file and filter out the files that don't need to be edited.
+func lookupFiles(files []fileData, catCounts *catCounts, state *state) {
+	mappings := state.mappings.get()
+	mapCategories(files, mappings, state)
+	cacheCatCounts(files, state.client, state.titleLimit, catCounts)
+	filterCatLimit(files, state.client, state.flags.CatFileLimit, catCounts)
+	filterCategories(files, state.client, state.titleLimit, state.flags.IgnoreCurrentCats, mappings.allCategories, state.site)
+}
+
+// Print the messages left by the lookup stage and count what it found.
+// This is done as the edit stage reaches each batch, so that nothing is
+// reported for files the lookups ran ahead to if a limit stops processing.
+func reportLookups(files []fileData, state *state) {
+	for i := range files {
+		for _, message := range files[i].messages {
+			if message.verbose {
+				state.verbose.Print(message.text)
+			} else {
+				warn.Print(message.text)
+			}
+		}
+		files[i].messages = nil
+		if files[i].make != "" || files[i].model != "" {
+			atomic.AddInt32(&state.stats.withCamera, 1)
+		}
+		if files[i].warning != "" {
+			atomic.AddInt32(&state.stats.warnings, 1)
+		}
+		switch files[i].outcome {
+		case outcomeInCat:
+			atomic.AddInt32(&state.stats.inCat, 1)
+		case outcomePopulated:
+			atomic.AddInt32(&state.stats.populated, 1)
+		case outcomeHandled:
+			atomic.AddInt32(&state.stats.handled, 1)
 		}
 	}
 }
 
-func processFiles(files []fileData, catCounts map[string]int32, state *state) {
-	mapCategories(files, state)
-	cacheCatCounts(files, state.client, catCounts)
-	filterCatLimit(files, state.client, &state.verbose, state.flags.CatFileLimit, catCounts, &state.stats)
-	filterCategories(files, state.client, &state.verbose, state.flags.IgnoreCurrentCats, state.allCategories, &state.stats)
+func processFiles(files []fileData, catCounts *catCounts, state *state) {
+	lookupFiles(files, catCounts, state)
+	reportLookups(files, state)
 	addCategories(files, catCounts, state)
+	state.processed.record(files)
 }
 
 // Data obtained about a single Wiki file page.
@@ -372,23 +424,92 @@ type fileData struct {
 	model     string        // Equipment model from Exif.
 	catMapped string        // Category name	mapped from Exif equipment make/model, or blank if the lookup fails.
 	processed bool          // True once file has been fully processed.
+	handled   bool          // True if processed and no further action will be needed unless the file or mapping changes.
+	sha1      string        // SHA-1 of the file's current version.
 	warning   string        // Brief warning string.
+	outcome   lookupOutcome // What the lookup stage found, if it settled the file.
+	messages  []fileMessage // Messages from the lookup stage, not yet printed.
+}
+
+// What the lookup stage found for a file it settled without a warning.
+type lookupOutcome int
+
+const (
+	outcomeNone      lookupOutcome = iota
+	outcomeInCat                   // Already in a relevant category.
+	outcomePopulated               // Mapped category has reached CatFileLimit.
+	outcomeHandled                 // Handled in an earlier run.
+)
+
+// A message about a file, printed to the verbose log or as a warning.
+type fileMessage struct {
+	verbose bool
+	text    string
+}
+
+// Record a verbose message about the file.
+func (f *fileData) note(v ...interface{}) {
+	f.messages = append(f.messages, fileMessage{true, fmt.Sprint(v...)})
 }
 
-func checkWarnings(gallery string, warnings *warnings, client *mwclient.Client) {
+// Set the file's warning, recording a message about it.
+func (f *fileData) warn(warning string, v ...interface{}) {
+	f.warning = warning
+	f.messages = append(f.messages, fileMessage{false, fmt.Sprint(v...)})
+}
+
+func checkWarnings(gallery string, warnings *warnings, client wiki, editor *editor) {
 	if len(*warnings) > 0 {
-		warnings.createGallery(gallery, client)
+		warnings.createGallery(gallery, client, editor)
 	}
 }
 
-func processGenerator(params params.Values, state *state) {
-	catCounts := make(map[string]int32)
-	warnings := make(warnings, 0, 200)
-	if state.flags.Gallery != "" {
-		// try to write gallery even if there's a panic while processing files.
-		defer checkWarnings(state.flags.Gallery, &warnings, state.client)
+// Number of batches that the query and lookup stages may run ahead of the
+// edits.
+const pipelineDepth = 4
+
+// Forward a panic in a pipeline goroutine to the editing goroutine, so that
+// it's raised where the deferred gallery and cleanup handlers will run.
+func forwardPanic(panics chan<- interface{}) {
+	if r := recover(); r != nil {
+		panics <- r
+	}
+}
+
+// Files passed between the stages, with the actions to take once they and
+// all the files before them have been processed.
+type batch struct {
+	files []fileData
+	done  []func()
+}
+
+// What the query stage did, to be read once it has finished.
+type fetchResult struct {
+	batches   int  // Number of batches sent to the lookup stage.
+	exhausted bool // True if there were no more results.
+}
+
+// Query stage: page through the query results, sending each batch of files
+// to the lookup stage, until at least fileLimit files are sent if not zero.
+func fetchBatches(query results, fileLimit int32, state *state, out chan<- batch, result *fetchResult, stop <-chan struct{}, panics chan<- interface{}) {
+	defer close(out)
+	defer forwardPanic(panics)
+	checkpoints := func() []func() {
+		if cp, ok := query.(checkpointer); ok {
+			return cp.checkpoints()
+		}
+		return nil
 	}
-	query := state.client.NewQuery(params)
+	send := func(b batch) bool {
+		select {
+		case out <- b:
+			result.batches++
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	var fetched int32
 	for query.Next() {
 		json := query.Resp()
 		pages, err := json.GetObjectArray("query", "pages")
@@ -397,24 +518,22 @@ func processGenerator(params params.Values, state *state) {
 			continue
 		}
 		if len(pages) == 0 {
-			break
-		} else {
-			files := make([]fileData, len(pages))
-			for i, _ := range pages {
-				files[i].pageObj, err = pages[i].Object()
-				if err != nil {
-					panic(err)
-				}
-				state.stats.examined++
+			result.exhausted = true
+			return
+		}
+		files := make([]fileData, len(pages))
+		for i, _ := range pages {
+			files[i].pageObj, err = pages[i].Object()
+			if err != nil {
+				panic(err)
 			}
-			processFiles(files, catCounts, state)
-			warnings.Append(files)
 		}
-		if state.flags.FileLimit > 0 && state.stats.examined >= state.flags.FileLimit {
-			break
+		if !send(batch{files, checkpoints()}) {
+			return
 		}
-		if state.flags.WarningLimit > 0 && state.stats.warnings >= state.flags.WarningLimit {
-			break
+		fetched += int32(len(files))
+		if fileLimit > 0 && fetched >= fileLimit {
+			return
 		}
 	}
 	if query.Err() != nil {
@@ -422,6 +541,126 @@ func processGenerator(params params.Values, state *state) {
 		// reducing the batch size (-s option).
 		panic(query.Err())
 	}
+	if done := checkpoints(); done != nil && !send(batch{done: done}) {
+		return
+	}
+	result.exhausted = true
+}
+
+// Lookup stage: map and filter each batch of files, sending the ones that
+// may need editing to the edit stage.
+func lookupBatches(in <-chan batch, out chan<- batch, catCounts *catCounts, state *state, stop <-chan struct{}, panics chan<- interface{}) {
+	defer close(out)
+	defer forwardPanic(panics)
+	for batch := range in {
+		state.mappings.reload()
+		lookupFiles(batch.files, catCounts, state)
+		select {
+		case out <- batch:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Process the files returned by a generator query.
+func processGenerator(params params.Values, state *state) bool {
+	return processQuery(newQuery(state.client, params), state.flags.FileLimit, state)
+}
+
+// Process the files returned by a query. Paging through the query and the
+// lookups needed to decide what to do with each file run ahead in separate
+// goroutines, while edits are done here, one at a time. Stops after
+// examining at least fileLimit files if not zero. Returns true if all the
+// files were processed, or false if a limit stopped processing early.
+func processQuery(query results, fileLimit int32, state *state) bool {
+	catCounts := newCatCounts(state.catCountCache)
+	warnings := make(warnings, 0, 200)
+	if state.flags.Gallery != "" {
+		// try to write gallery even if there's a panic while processing files.
+		defer checkWarnings(state.flags.Gallery, &warnings, state.client, state.editor)
+	}
+	fetched := make(chan batch, pipelineDepth)
+	looked := make(chan batch, pipelineDepth)
+	stop := make(chan struct{})
+	panics := make(chan interface{}, 2)
+	var wg sync.WaitGroup
+	var result fetchResult
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		fetchBatches(query, fileLimit, state, fetched, &result, stop, panics)
+	}()
+	go func() {
+		defer wg.Done()
+		lookupBatches(fetched, looked, catCounts, state, stop, panics)
+	}()
+	var once sync.Once
+	shutdown := func() {
+		// Shut down the other stages if editing stops early.
+		once.Do(func() {
+			close(stop)
+			if s, ok := query.(stoppable); ok {
+				s.Stop()
+			}
+			wg.Wait()
+		})
+	}
+	defer shutdown()
+	edited := 0 // Batches that were completely processed.
+	for batch := range looked {
+		files := batch.files
+		reportLookups(files, state)
+		state.stats.examined += int32(len(files))
+		addCategories(files, catCounts, state)
+		complete := allProcessed(files)
+		if complete {
+			edited++
+		}
+		warnings.Append(files)
+		state.processed.record(files)
+		state.processed.saveIfDue()
+		state.catCountCache.saveIfDue()
+		if complete {
+			for _, done := range batch.done {
+				done()
+			}
+		}
+		if fileLimit > 0 && state.stats.examined >= fileLimit {
+			warn.Print("Stopping: file limit reached.")
+			break
+		}
+		if state.flags.WarningLimit > 0 && atomic.LoadInt32(&state.stats.warnings) >= state.flags.WarningLimit {
+			warn.Print("Stopping: warning limit reached.")
+			break
+		}
+		if state.editor.limiter.capReached() {
+			warn.Print("Stopping: edit limit reached.")
+			break
+		}
+		if state.editor.stopped() {
+			warn.Print("Stopping: not logged in.")
+			break
+		}
+	}
+	shutdown()
+	select {
+	case r := <-panics:
+		panic(r)
+	default:
+	}
+	// Editing may have stopped early at the last batch without leaving
+	// anything out.
+	return result.exhausted && result.batches == edited
+}
+
+func allProcessed(files []fileData) bool {
+	for i := range files {
+		if !files[i].processed {
+			return false
+		}
+	}
+	return true
 }
 
 func backString(back bool) string {
@@ -432,7 +671,9 @@ func backString(back bool) string {
 	}
 }
 
-func processUser(user string, ts timestamp, state *state) {
+// Process the files uploaded by a user, starting from start and ending at
+// end, inclusive, if they are valid.
+func processUser(user string, start, end timestamp, state *state) {
 	params := params.Values{
 		"generator": "allimages",
 		"gaiuser":   strings.TrimPrefix(user, "User:"),
@@ -440,29 +681,41 @@ func processUser(user string, ts timestamp, state *state) {
 		"gaidir":    backString(state.flags.Back),
 		"gailimit":  strconv.Itoa(state.flags.BatchSize),
 		"prop":      "imageinfo",
-		"iiprop":    "commonmetadata",
+		"iiprop":    "commonmetadata|sha1",
 	}
-	if ts.valid {
-		params["gaistart"] = ts.string
+	if start.valid {
+		params["gaistart"] = start.string
+	}
+	if end.valid {
+		params["gaiend"] = end.string
 	}
 	processGenerator(params, state)
 }
 
-func processCategory(category string, ts timestamp, state *state) {
+// Process the files in a category, added to it between start and end,
+// inclusive, if they are valid.
+func processCategory(category string, start, end timestamp, state *state) {
+	if state.flags.Depth > 0 {
+		processCategoryTree(category, start, end, state)
+		return
+	}
 	// Sorting is by the last modification of the file page. Image upload
 	// time would be preferable.
 	params := params.Values{
 		"generator":    "categorymembers",
 		"gcmtitle":     category,
-		"gcmnamespace": "6", // namespace 6 for files on Commons.
+		"gcmnamespace": strconv.Itoa(state.site.fileNamespace),
 		"gcmsort":      "timestamp",
 		"gcmdir":       backString(state.flags.Back),
 		"gcmlimit":     strconv.Itoa(state.flags.BatchSize),
 		"prop":         "imageinfo",
-		"iiprop":       "commonmetadata",
+		"iiprop":       "commonmetadata|sha1",
+	}
+	if start.valid {
+		params["gcmstart"] = start.string
 	}
-	if ts.valid {
-		params["gcmstart"] = ts.string
+	if end.valid {
+		params["gcmend"] = end.string
 	}
 	processGenerator(params, state)
 }
@@ -472,18 +725,63 @@ func processRandom(state *state) {
 	if state.flags.BatchSize < 20 {
 		batchSize = state.flags.BatchSize
 	}
-	for {
+	for !state.editor.limiter.capReached() && !state.editor.stopped() {
 		params := params.Values{
 			"generator":    "random",
-			"grnnamespace": "6", // namespace 6 for files on Commons.
+			"grnnamespace": strconv.Itoa(state.site.fileNamespace),
 			"grnlimit":     strconv.Itoa(batchSize),
 			"prop":         "imageinfo",
-			"iiprop":       "commonmetadata",
+			"iiprop":       "commonmetadata|sha1",
 		}
 		processGenerator(params, state)
 	}
 }
 
+// Process the files found by a search query, e.g., with CirrusSearch
+// keywords such as filemime: and insource:.
+func processSearch(search string, state *state) {
+	params := params.Values{
+		"generator":    "search",
+		"gsrsearch":    search,
+		"gsrnamespace": strconv.Itoa(state.site.fileNamespace),
+		"gsrlimit":     strconv.Itoa(titlesBatchSize(state)), // Search has the same limit as titles.
+		"prop":         "imageinfo",
+		"iiprop":       "commonmetadata|sha1",
+	}
+	processGenerator(params, state)
+}
+
+// Process files given by title, in batches of BatchSize or the maximum
+// number of titles in a query if less. Returns true if all the files were
+// processed.
+func processTitles(titles []string, state *state) bool {
+	return processQuery(newTitlesQuery(state.client, titlesParams(), titles, titlesBatchSize(state)), state.flags.FileLimit, state)
+}
+
+// Process files given by title as a source produces them, batched as by
+// processTitles, stopping after at least fileLimit files if not zero.
+// Returns true if the source ran out and all the files were processed.
+func processSource(source titleSource, fileLimit int32, state *state) bool {
+	return processQuery(newSourceQuery(state.client, titlesParams(), source, titlesBatchSize(state)), fileLimit, state)
+}
+
+// Return the parameters of a query for the files given by title.
+func titlesParams() params.Values {
+	return params.Values{
+		"prop":      "imageinfo",
+		"iiprop":    "commonmetadata|sha1",
+		"redirects": "", // follow redirects
+	}
+}
+
+// Return BatchSize, or the maximum number of titles in a query if less.
+func titlesBatchSize(state *state) int {
+	if state.flags.BatchSize > state.titleLimit {
+		return state.titleLimit
+	}
+	return state.flags.BatchSize
+}
+
 // Process the images embedded in a page, e.g., a gallery.
 func processPage(page string, state *state) {
 	params := params.Values{
@@ -491,12 +789,14 @@ func processPage(page string, state *state) {
 		"titles":    page,
 		"gimlimit":  strconv.Itoa(state.flags.BatchSize),
 		"prop":      "imageinfo",
-		"iiprop":    "commonmetadata",
+		"iiprop":    "commonmetadata|sha1",
 	}
 	processGenerator(params, state)
 }
 
-func processAll(ts timestamp, state *state) {
+// Process all files uploaded from start, up to end, inclusive, if it is
+// valid.
+func processAll(start, end timestamp, state *state) {
 	var direction string
 	if state.flags.Back {
 		direction = "descending"
@@ -507,21 +807,24 @@ func processAll(ts timestamp, state *state) {
 		"generator": "allimages",
 		"gaisort":   "timestamp",
 		"gaidir":    direction,
-		"gaistart":  ts.string,
+		"gaistart":  start.string,
 		"gailimit":  strconv.Itoa(state.flags.BatchSize),
 		"prop":      "imageinfo",
-		"iiprop":    "commonmetadata",
+		"iiprop":    "commonmetadata|sha1",
+	}
+	if end.valid {
+		params["gaiend"] = end.string
 	}
 	processGenerator(params, state)
 }
 
 // Return a json object containing page title and imageinfo (Exif) data.
-func GetImageinfo(page string, client *mwclient.Client) *jason.Object {
+func GetImageinfo(page string, client wiki) *jason.Object {
 	params := params.Values{
 		"action":    "query",
 		"titles":    page,
 		"prop":      "imageinfo",
-		"iiprop":    "commonmetadata",
+		"iiprop":    "commonmetadata|sha1",
 		"redirects": "", // follow redirects
 		"continue":  "",
 	}
@@ -547,7 +850,7 @@ func GetImageinfo(page string, client *mwclient.Client) *jason.Object {
 }
 
 func processOneFile(page string, state *state) {
-	catCounts := make(map[string]int32)
+	catCounts := newCatCounts(state.catCountCache)
 	files := make([]fileData, 1)
 	files[0].pageObj = GetImageinfo(page, state.client)
 	if files[0].pageObj == nil {
@@ -558,27 +861,68 @@ func processOneFile(page string, state *state) {
 }
 
 type flags struct {
-	Verbose           bool   `short:"v" long:"verbose" env:"takenwith_verbose" description:"Print action for every file"`
-	CatFileLimit      int32  `short:"c" long:"catfilelimit" env:"takenwith_catfilelimit" description:"Don't add to categories with at least this many files. No limit if zero" default:"100"`
-	Operator          string `long:"operator" env:"takenwith_operator" description:"Operator's email address or Wiki user name"`
-	MappingFile       string `long:"mappingfile" env:"takenwith_mappingfile" description:"Path of the catmapping file"`
-	ExceptionFile     string `long:"exceptionfile" env:"takenwith_exceptionfile" description:"Path of the catexceptions file"`
-	RegexFile         string `long:"regexfile" env:"takenwith_regexfile" description:"Path of the category regex file"`
-	CookieFile        string `long:"cookiefile" env:"takenwith_cookiefile" description:"Path of the cookies cache file"`
-	BatchSize         int    `short:"s" long:"batchsize" env:"takenwith_batchsize" description:"Number of files to process per server request" default:"100"`
-	IgnoreCurrentCats bool   `short:"i" long:"ignorecurrentcats" env:"takenwith_ignorecurrentcats" description:"Add to mapped categories even if already in a relevant category"`
-	Back              bool   `short:"b" long:"back" env:"takenwith_back" description:"Process backwards in time, from newer files to older files"`
-	FileLimit         int32  `short:"f" long:"filelimit" env:"takenwith_filelimit" description:"Stop after examining at least this many files. No limit if zero" default:"10000"`
-	WarningLimit      int32  `short:"w" long:"warninglimit" env:"takenwith_warninglimit" description:"Stop after printing at least this many warnings. No limit if zero" default:"100"`
-	Gallery           string `long:"gallery" env:"takenwith_gallery" description:"Gallery page in which to display files with warnings"`
-	Remove            string `short:"r" long:"remove" env:"takenwith_remove" description:"When adding a category, remove this category. Do not include a Category: prefix."`
+	Config             string        `long:"config" env:"takenwith_config" description:"Path of a config file setting options by their long names"`
+	Profile            string        `long:"profile" env:"takenwith_profile" description:"Section of the config file to use, e.g., commons-prod"`
+	Verbose            bool          `short:"v" long:"verbose" env:"takenwith_verbose" description:"Print action for every file"`
+	CatFileLimit       int32         `short:"c" long:"catfilelimit" env:"takenwith_catfilelimit" description:"Don't add to categories with at least this many files. No limit if zero" default:"100"`
+	Operator           string        `long:"operator" env:"takenwith_operator" description:"Operator's email address or Wiki user name"`
+	MappingFile        []string      `long:"mappingfile" env:"takenwith_mappingfile" env-delim:"," description:"Path of a catmapping file or directory of them; may be repeated, with later entries overriding earlier ones. Defaults to the copy built into the program"`
+	ExceptionFile      []string      `long:"exceptionfile" env:"takenwith_exceptionfile" env-delim:"," description:"Path of a catexceptions file or directory of them; may be repeated. Defaults to the copy built into the program"`
+	RegexFile          []string      `long:"regexfile" env:"takenwith_regexfile" env-delim:"," description:"Path of a category regex file or directory of them; may be repeated, with later entries tried first. Defaults to the copy built into the program"`
+	LocalMappingFile   string        `long:"localmappingfile" env:"takenwith_localmappingfile" description:"Path of a catmapping file loaded after the main one, whose entries override it"`
+	LocalExceptionFile string        `long:"localexceptionfile" env:"takenwith_localexceptionfile" description:"Path of a catexceptions file loaded in addition to the main one"`
+	LocalRegexFile     string        `long:"localregexfile" env:"takenwith_localregexfile" description:"Path of a category regex file whose entries are tried before the main one's"`
+	CookieFile         string        `long:"cookiefile" env:"takenwith_cookiefile" description:"Path of the cookies cache file. Not needed with OAuth"`
+	OAuthFile          string        `long:"oauthfile" env:"takenwith_oauthfile" description:"Path of a file with owner-only OAuth consumer credentials, to use instead of a username and password"`
+	BatchSize          int           `short:"s" long:"batchsize" env:"takenwith_batchsize" description:"Number of files to process per server request" default:"100"`
+	IgnoreCurrentCats  bool          `short:"i" long:"ignorecurrentcats" env:"takenwith_ignorecurrentcats" description:"Add to mapped categories even if already in a relevant category"`
+	Back               bool          `short:"b" long:"back" env:"takenwith_back" description:"Process backwards in time, from newer files to older files"`
+	Depth              int           `long:"depth" env:"takenwith_depth" description:"Also process the files in subcategories of a category, down to this many levels below it"`
+	IncludeCategory    []string      `long:"includecategory" env:"takenwith_includecategory" env-delim:"," description:"Regular expression for the names of subcategories to process with --depth; may be repeated. All are processed if not given"`
+	ExcludeCategory    []string      `long:"excludecategory" env:"takenwith_excludecategory" env-delim:"," description:"Regular expression for the names of subcategories not to process with --depth; may be repeated"`
+	FileLimit          int32         `short:"f" long:"filelimit" env:"takenwith_filelimit" description:"Stop after examining at least this many files. No limit if zero. Not applied to the Recent and Stream commands" default:"10000"`
+	WarningLimit       int32         `short:"w" long:"warninglimit" env:"takenwith_warninglimit" description:"Stop after printing at least this many warnings. No limit if zero" default:"100"`
+	Gallery            string        `long:"gallery" env:"takenwith_gallery" description:"Gallery page in which to display files with warnings"`
+	Remove             string        `short:"r" long:"remove" env:"takenwith_remove" description:"When adding a category, remove this category. Do not include a Category: prefix."`
+	EditRate           float64       `long:"editrate" env:"takenwith_editrate" description:"Maximum number of edits per minute" default:"12"`
+	EditBurst          int           `long:"editburst" env:"takenwith_editburst" description:"Number of edits that may be made at once before the edit rate applies" default:"1"`
+	API                string        `long:"api" env:"takenwith_api" description:"URL of the Wiki's api.php" default:"https://commons.wikimedia.org/w/api.php"`
+	FileNamespace      int           `long:"filenamespace" env:"takenwith_filenamespace" description:"Namespace ID of file pages" default:"6"`
+	CategoryPrefix     string        `long:"categoryprefix" env:"takenwith_categoryprefix" description:"Category namespace prefix, including the colon. Defaults to the Wiki's local name"`
+	TargetPrefix       string        `long:"targetprefix" env:"takenwith_targetprefix" description:"Prepended to mapping file targets that don't have a category prefix" default:"Taken with "`
+	ScannerPrefix      string        `long:"scannerprefix" env:"takenwith_scannerprefix" description:"Prefix of scanner categories" default:"Scanned with "`
+	Record             string        `long:"record" env:"takenwith_record" description:"Record requests to the Wiki and their responses in this fixture file"`
+	Replay             string        `long:"replay" env:"takenwith_replay" description:"Answer requests to the Wiki from this fixture file instead of the Wiki"`
+	Assert             string        `long:"assert" env:"takenwith_assert" choice:"user" choice:"bot" description:"Account type asserted with every edit. If the assertion fails, log in again" default:"user"`
+	ProcessedFile      string        `long:"processedfile" env:"takenwith_processedfile" description:"Path of a file recording the files already handled, which later runs skip unless the file or its mapped category changed"`
+	CatCountFile       string        `long:"catcountfile" env:"takenwith_catcountfile" description:"Path of a file caching category file counts between runs"`
+	CatCountTTL        time.Duration `long:"catcountttl" env:"takenwith_catcountttl" description:"How long cached category file counts are used before fetching them again. Ten times longer for categories far above catfilelimit" default:"24h"`
+	RecentFile         string        `long:"recentfile" env:"takenwith_recentfile" description:"Path of a file keeping the position reached by the Recent command, so that it continues from there"`
+	PollInterval       time.Duration `long:"pollinterval" env:"takenwith_pollinterval" description:"How often the Recent command checks for new uploads, and the longest the Stream command waits to fill a batch" default:"2m"`
+	StreamURL          string        `long:"streamurl" env:"takenwith_streamurl" description:"URL of the event stream of page creations for the Stream command" default:"https://stream.wikimedia.org/v2/stream/mediawiki.page-create"`
+	MaxEdits           int32         `long:"maxedits" env:"takenwith_maxedits" description:"Stop after adding categories to this many files. No limit if zero" default:"0"`
 }
 
-func parseFlags() ([]string, flags) {
+// Parse command line arguments, applying the config file if any.
+func parseArgs(cmdArgs []string) ([]string, flags, error) {
 	var flags flags
-	parser := goflags.NewParser(&flags, goflags.HelpFlag)
-	parser.Usage = "[OPTIONS] File:f | User:u [timestamp] | Category:c [timestamp] | Random | Page:p | All timestamp"
-	args, err := parser.Parse()
+	// Arguments after "--" aren't options, e.g., a timestamp of -7d.
+	parser := goflags.NewParser(&flags, goflags.HelpFlag|goflags.PassDoubleDash)
+	parser.Usage = "[OPTIONS] File:f | User:u [timestamp [end]] | Category:c [timestamp [end]] | Random | Page:p | Search:query | List:path | - | Recent [timestamp] | Stream | All timestamp [end]"
+	args, err := parser.ParseArgs(cmdArgs)
+	if err != nil {
+		return nil, flags, err
+	}
+	if flags.Config != "" {
+		err = applyConfig(parser, flags.Config, flags.Profile)
+	} else if flags.Profile != "" {
+		err = errors.New("Profile given without a config file.")
+	}
+	return args, flags, err
+}
+
+func parseFlags() ([]string, flags) {
+	args, flags, err := parseArgs(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -586,13 +930,20 @@ func parseFlags() ([]string, flags) {
 }
 
 // Handler for processing to be done when bot is terminating.
-func EndProc(client *mwclient.Client, stats *stats, cookieFile string) {
+func EndProc(state *state) {
 	// Cookies can change while the bot is running, so save the latest values for the next run.
-	mwlib.WriteCookies(client.DumpCookies(), cookieFile)
+	saveCookies(state)
+
+	if recorder, ok := state.client.(*recorder); ok {
+		recorder.save()
+	}
+
+	state.processed.save()
+	state.catCountCache.save()
 
-	if stats.examined > 1 {
+	if state.stats.examined > 1 {
 		fmt.Println()
-		stats.print()
+		state.stats.print()
 	}
 }
 
@@ -610,28 +961,22 @@ func get_verbose(verbose bool) *log.Logger {
 }
 
 // Return true if the client is logged in.
-func checkLogin(client *mwclient.Client) bool {
+func checkLogin(client wiki, assert string) bool {
 	params := params.Values{
 		"action":   "query",
-		"assert":   "user",
+		"assert":   assert,
 		"continue": "",
 	}
 	_, err := client.Get(params)
 	return err == nil
 }
 
-func clearCookies(client *mwclient.Client, cookieFile string) {
-	cookies := mwlib.ReadCookies(cookieFile)
-	for idx, _ := range cookies {
-		cookies[idx].MaxAge = -1
+func login(state *state) bool {
+	if state.flags.OAuthFile != "" {
+		// OAuth requests are signed, so there's nothing to log in.
+		warn.Print("OAuth credentials not accepted by the Wiki.")
+		return false
 	}
-	client.LoadCookies(cookies)
-}
-
-func login(client *mwclient.Client, flags flags) bool {
-	// Clear old session cookies, otherwise they remain in the cookiejar
-	// as duplicates and remain in use.
-	clearCookies(client, flags.CookieFile)
 	username := os.Getenv("takenwith_username")
 	if username == "" {
 		warn.Print("Username for login not set in environment.")
@@ -642,112 +987,273 @@ func login(client *mwclient.Client, flags flags) bool {
 		warn.Print("Password for login not set in environment.")
 		return false
 	}
-	err := client.Login(username, password)
+	forgetOldCookies(state)
+	login := state.client.Login
+	if state.flags.CookieFile != "" {
+		login = dumpingLogin(state.client, state.cookies)
+	}
+	err := login(username, password)
 	if err != nil {
 		log.Print(err)
 		return false
 	}
+	// Edits would fail the assertion, however many times we logged in.
+	if !checkLogin(state.client, state.flags.Assert) {
+		warn.Printf("Logged in, but the Wiki rejects the assertion that the account is a %s account. Check --assert.", state.flags.Assert)
+		return false
+	}
 	return true
 }
 
-func main() {
-	var state state
-	var args []string
-	args, state.flags = parseFlags()
-	if state.flags.Operator == "" {
-		warn.Print("Operator email / username not set.")
+// Remove the cookies loaded without attributes, e.g., from a version 1
+// cookie file, from the client before logging in. The jar gives them a
+// default path, so they would otherwise be kept alongside the new session's
+// cookies and sent before them.
+func forgetOldCookies(state *state) {
+	if len(state.oldCookies) == 0 {
 		return
 	}
-	if state.flags.MappingFile == "" {
-		warn.Print("Category mapping file path not set.")
-		return
+	expired := make([]*http.Cookie, len(state.oldCookies))
+	for i, cookie := range state.oldCookies {
+		expired[i] = &http.Cookie{Name: cookie.Name, Value: cookie.Value, MaxAge: -1}
 	}
-	if state.flags.ExceptionFile == "" {
-		warn.Print("Category exception file path not set.")
-		return
+	state.client.LoadCookies(expired)
+	state.oldCookies = nil
+}
+
+// Return a function that logs in with a copy of the client that dumps its
+// requests and responses to w, which is the only way to see the attributes
+// of the cookies the Wiki sets. The copy shares the client's cookie jar, so
+// the session is the client's, while other requests aren't dumped and the
+// client isn't changed while other goroutines use it.
+func dumpingLogin(client wiki, w io.Writer) func(username, password string) error {
+	switch c := client.(type) {
+	case *mwclient.Client:
+		dumping := *c
+		dumping.Tokens = make(map[string]string)
+		dumping.SetDebug(w)
+		return dumping.Login
+	case *recorder:
+		login := dumpingLogin(c.client, w)
+		return func(username, password string) error {
+			return c.recordLogin(login, username, password)
+		}
 	}
-	if state.flags.RegexFile == "" {
-		warn.Print("Category regex file path not set.")
-		return
+	return client.Login
+}
+
+// Check the flags, connect to the Wiki and load the mapping files. Returns
+// false if the bot can't run.
+func setup(state *state) bool {
+	if state.flags.Operator == "" {
+		warn.Print("Operator email / username not set.")
+		return false
 	}
-	if state.flags.CookieFile == "" {
+	if state.flags.CookieFile == "" && state.flags.OAuthFile == "" {
 		warn.Print("Cookie cache file path not set.")
-		return
+		return false
 	}
 	state.verbose = *get_verbose(state.flags.Verbose)
-	var err error
-	state.client, err = mwclient.New("https://commons.wikimedia.org/w/api.php", "takenwith "+state.flags.Operator)
-	if err != nil {
-		panic(err)
+	state.cookies = mwlib.NewCookieAttributes()
+	if state.flags.EditRate <= 0 {
+		warn.Print("Edit rate must be positive.")
+		return false
+	}
+	if state.flags.Replay != "" {
+		state.client = newReplayer(state.flags.Replay)
+	} else {
+		client, err := mwclient.New(state.flags.API, "takenwith "+state.flags.Operator)
+		if err != nil {
+			panic(err)
+		}
+		client.Maxlag.On = true
+		if state.flags.OAuthFile != "" {
+			keys, err := readOAuthKeys(state.flags.OAuthFile)
+			if err != nil {
+				warn.Print(err)
+				return false
+			}
+			err = client.OAuth(keys.consumerToken, keys.consumerSecret, keys.accessToken, keys.accessSecret)
+			if err != nil {
+				panic(err)
+			}
+		}
+		state.client = client
+	}
+	if state.flags.Record != "" {
+		state.client = newRecorder(state.client, state.flags.Record)
 	}
-	state.client.Maxlag.On = true
-
-	cookies := mwlib.ReadCookies(state.flags.CookieFile)
-	state.client.LoadCookies(cookies)
-
-	state.categoryMap = fillCategoryMap(state.flags.MappingFile) // makemodel -> category
 
-	// All known categories, including those that aren't catmapping
-	// targets.
-	state.allCategories = fillCategories(state.categoryMap, state.flags.ExceptionFile)
+	if state.flags.CookieFile != "" {
+		cookies := mwlib.ReadCookies(state.flags.CookieFile)
+		state.cookies.Add(cookies)
+		state.client.LoadCookies(cookies)
+		for _, cookie := range cookies {
+			if cookie.Path == "" {
+				state.oldCookies = append(state.oldCookies, cookie)
+			}
+		}
+	}
 
-	state.catRegex = fillRegex(state.flags.RegexFile)
+	state.editor = &editor{
+		client: state.client,
+		// The default rate of one edit per 5 seconds follows Commons bot policy.
+		limiter: newEditLimiter(state.flags.EditRate, state.flags.EditBurst, state.flags.MaxEdits),
+		assert:  state.flags.Assert,
+		relogin: func() bool { return relogin(state) },
+	}
 
-	defer EndProc(state.client, &state.stats, state.flags.CookieFile)
+	state.site = newSite(state.client, state.flags.FileNamespace, state.flags.CategoryPrefix, state.flags.TargetPrefix, state.flags.ScannerPrefix)
 
-	if !checkLogin(state.client) {
-		if !login(state.client, state.flags) {
-			return
-		}
+	var err error
+	state.mappings, err = newMappingFiles(state.flags, state.site)
+	if err != nil {
+		warn.Print(err)
+		return false
+	}
+	state.processed, err = readProcessed(state.flags.ProcessedFile)
+	if err != nil {
+		warn.Print(err)
+		return false
 	}
+	state.catCountCache, err = readCatCountCache(state.flags.CatCountFile, state.flags.CatCountTTL, state.flags.CatFileLimit)
+	if err != nil {
+		warn.Print(err)
+		return false
+	}
+	return true
+}
 
+// Run the command given on the command line.
+func runCommand(args []string, state *state) {
 	numArgs := len(args)
-	if numArgs == 0 || numArgs > 2 {
-		warn.Print("Command [timestamp] expected.")
+	if numArgs == 0 || numArgs > 3 {
+		warn.Print("Command [timestamp [end timestamp]] expected.")
 		return
 	}
-	if strings.HasPrefix(args[0], "File:") {
+	state.titleLimit = titleLimit(state.client)
+	if state.site.isFile(args[0]) {
 		if numArgs > 1 {
 			warn.Print("Unexpected parameter.")
 			return
 		}
-		processOneFile(args[0], &state)
+		processOneFile(args[0], state)
 	} else if args[0] == "Random" {
 		if numArgs > 1 {
 			warn.Print("Unexpected parameter.")
 			return
 		}
-		processRandom(&state)
+		processRandom(state)
 	} else if strings.HasPrefix(args[0], "Page:") {
 		if numArgs > 1 {
 			warn.Print("Unexpected parameter.")
 			return
 		}
-		processPage(args[0][5:], &state)
+		processPage(args[0][5:], state)
+	} else if strings.HasPrefix(args[0], "Search:") {
+		if numArgs > 1 {
+			warn.Print("Unexpected parameter.")
+			return
+		}
+		processSearch(strings.TrimPrefix(args[0], "Search:"), state)
+	} else if strings.HasPrefix(args[0], "List:") || args[0] == "-" {
+		if numArgs > 1 {
+			warn.Print("Unexpected parameter.")
+			return
+		}
+		processList(strings.TrimPrefix(args[0], "List:"), state)
+	} else if args[0] == "Stream" {
+		if numArgs > 1 {
+			warn.Print("Unexpected parameter.")
+			return
+		}
+		processStream(state)
 	} else {
-		var ts timestamp
-		if numArgs == 2 {
-			ts, err = newTimestamp(args[1])
-			if err != nil {
+		start, end := newTimestampEmpty(), newTimestampEmpty()
+		var err error
+		if numArgs > 1 {
+			if start, err = commandTimestamp(args[1], state); err != nil {
+				warn.Print(err)
+				return
+			}
+		}
+		if numArgs > 2 {
+			if end, err = commandTimestamp(args[2], state); err != nil {
+				warn.Print(err)
+				return
+			}
+			if err := checkRange(start, end, state.flags.Back); err != nil {
 				warn.Print(err)
 				return
 			}
-		} else {
-			ts = newTimestampEmpty()
 		}
 		if strings.HasPrefix(args[0], "User:") {
-			processUser(args[0], ts, &state)
-		} else if strings.HasPrefix(args[0], "Category:") {
-			processCategory(args[0], ts, &state)
+			processUser(args[0], start, end, state)
+		} else if state.site.isCategory(args[0]) {
+			processCategory(args[0], start, end, state)
+		} else if args[0] == "Recent" {
+			if numArgs > 2 {
+				warn.Print("Unexpected parameter.")
+				return
+			}
+			processRecent(start, state)
 		} else if args[0] == "All" {
-			if numArgs != 2 {
+			if numArgs < 2 {
 				warn.Print("Timestamp required.")
 				return
 			}
-			processAll(ts, &state)
+			processAll(start, end, state)
 		} else {
 			warn.Print("Unknown command.")
 			return
 		}
 	}
 }
+
+// Log in again after the session has expired, saving the new cookies
+// straight away.
+func relogin(state *state) bool {
+	warn.Print("Session expired; logging in again.")
+	if !login(state) {
+		return false
+	}
+	clearTokens(state.client)
+	saveCookies(state)
+	return true
+}
+
+// Save the client's cookies to the cookie file, with their attributes.
+func saveCookies(state *state) {
+	if state.flags.CookieFile != "" {
+		mwlib.WriteCookies(state.cookies.Complete(state.client.DumpCookies()), state.flags.CookieFile)
+	}
+}
+
+// Discard tokens cached by mwclient, which belong to the old session.
+func clearTokens(client wiki) {
+	switch c := client.(type) {
+	case *mwclient.Client:
+		c.Tokens = make(map[string]string)
+	case *recorder:
+		clearTokens(c.client)
+	}
+}
+
+func main() {
+	var state state
+	var args []string
+	args, state.flags = parseFlags()
+	if !setup(&state) {
+		return
+	}
+
+	defer EndProc(&state)
+
+	if !checkLogin(state.client, state.flags.Assert) {
+		if !login(&state) {
+			return
+		}
+	}
+
+	runCommand(args, &state)
+}
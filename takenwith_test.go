@@ -0,0 +1,544 @@
+package main
+
+import (
+	"github.com/garyhouston/takenwith/mwlib"
+	goflags "github.com/jessevdk/go-flags"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testMapping = `Canon,Canon EOS 5D,Canon EOS 5D
+NIKON CORPORATION,NIKON D90,Nikon D90
+Acme,Widget,Category:Widgets
+`
+
+const testRegex = `Foo Corp.*,Foo cameras
+`
+
+const testExceptions = `Photos by Carol
+`
+
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Create a state for running against the fake Wiki, logged in, with extra
+// command line flags.
+func newTestState(t *testing.T, wiki *fakeWiki, args ...string) *state {
+	dir := t.TempDir()
+	defaults := []string{
+		"--operator", "test",
+		"--api", wiki.url(),
+		"--mappingfile", writeTestFile(t, dir, "catmapping", testMapping),
+		"--regexfile", writeTestFile(t, dir, "catregex", testRegex),
+		"--exceptionfile", writeTestFile(t, dir, "catexceptions", testExceptions),
+		"--cookiefile", filepath.Join(dir, "cookies"),
+		"--editrate", "60000",
+		"--editburst", "1000",
+		"--batchsize", "2",
+	}
+	var state state
+	if _, err := goflags.ParseArgs(&state.flags, append(defaults, args...)); err != nil {
+		t.Fatal(err)
+	}
+	if !setup(&state) {
+		t.Fatal("setup failed")
+	}
+	t.Setenv("takenwith_username", wiki.username)
+	t.Setenv("takenwith_password", wiki.password)
+	if !login(&state) {
+		t.Fatal("login failed")
+	}
+	return &state
+}
+
+// Run a command in a new state with extra command line flags, ending the
+// run as main does.
+func runTestCommand(t *testing.T, wiki *fakeWiki, command []string, args ...string) *state {
+	state := newTestState(t, wiki, args...)
+	runCommand(command, state)
+	EndProc(state)
+	return state
+}
+
+// A site with the namespaces of the fake Wiki, for tests that don't query
+// it.
+var testSite = &site{
+	fileNamespace:    6,
+	filePrefixes:     []string{"File:", "Image:"},
+	categoryPrefix:   "Category:",
+	categoryPrefixes: []string{"Category:"},
+	targetPrefix:     "Taken with ",
+}
+
+// Files uploaded by Alice cover each of the outcomes for a file.
+func addTestFiles(wiki *fakeWiki) {
+	wiki.addPage("Category:Taken with Canon EOS 5D", "")
+	wiki.addPage("Category:Taken with Nikon D90", "")
+	wiki.addPage("Category:Cats", "")
+	wiki.addFile("File:Existing 1.jpg", "Carol", "20100101000000", "", "", "[[Category:Taken with Canon EOS 5D]]")
+	wiki.addFile("File:Existing 2.jpg", "Carol", "20100102000000", "", "", "[[Category:Taken with Canon EOS 5D]]")
+	wiki.addFile("File:A.jpg", "Alice", "20190101000000", "Canon", "Canon EOS 5D", "A cat.\n[[Category:Cats]]\n<!-- [[Category:Dogs]] -->")
+	wiki.addFile("File:B.jpg", "Alice", "20190102000000", "Canon", "Canon EOS 5D", "[[Category:Taken with Canon EOS 5D]]")
+	wiki.addFile("File:C.jpg", "Alice", "20190103000000", "", "", "No Exif.")
+	wiki.addFile("File:D.jpg", "Alice", "20190104000000", "Unknown", "Thing", "Unmapped.")
+	wiki.addFile("File:E.jpg", "Alice", "20190105000000", "Foo Corp", "X1", "Mapped by regex to a missing category.")
+	wiki.addFile("File:F.jpg", "Bob", "20190106000000", "NIKON CORPORATION", "NIKON D90", "[[Category:Cats]]")
+}
+
+func checkStats(t *testing.T, got stats, want stats) {
+	t.Helper()
+	if got != want {
+		t.Errorf("stats: got %+v, want %+v", got, want)
+	}
+}
+
+func checkText(t *testing.T, wiki *fakeWiki, title, want string) {
+	t.Helper()
+	if got := wiki.text(title); got != want {
+		t.Errorf("%s: got text %q, want %q", title, got, want)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	wiki := newFakeWiki(t)
+	state := newTestState(t, wiki)
+	if !checkLogin(state.client, "user") {
+		t.Error("not logged in after login")
+	}
+	other := newTestState(t, wiki)
+	t.Setenv("takenwith_password", "wrong")
+	if login(other) {
+		t.Error("login succeeded with wrong password")
+	}
+}
+
+func TestSavedCookies(t *testing.T) {
+	wiki := newFakeWiki(t)
+	cookieFile := filepath.Join(t.TempDir(), "cookies")
+	state := newTestState(t, wiki, "--cookiefile", cookieFile)
+	EndProc(state)
+	cookies := mwlib.ReadCookies(cookieFile)
+	if len(cookies) != 1 || cookies[0].Path != "/" || !cookies[0].HttpOnly || cookies[0].Expires.IsZero() {
+		t.Fatalf("got cookies %+v", cookies)
+	}
+
+	// Logging in again replaces the saved session cookie in the jar
+	// instead of adding another.
+	state = newTestState(t, wiki, "--cookiefile", cookieFile)
+	if cookies := state.client.DumpCookies(); len(cookies) != 1 {
+		t.Errorf("got cookies %v", cookies)
+	}
+	if !checkLogin(state.client, "user") {
+		t.Error("not logged in")
+	}
+}
+
+func TestUpgradeVersion1Cookies(t *testing.T) {
+	wiki := newFakeWiki(t)
+	cookieFile := writeTestFile(t, t.TempDir(), "cookies", fakeSessionCookie+" stale\n")
+	state := newTestState(t, wiki, "--cookiefile", cookieFile)
+
+	// The stale cookie from the old file is replaced by the new session's,
+	// which is saved with its attributes.
+	if cookies := state.client.DumpCookies(); len(cookies) != 1 || cookies[0].Value == "stale" {
+		t.Errorf("got cookies %v", cookies)
+	}
+	EndProc(state)
+	data, err := os.ReadFile(cookieFile)
+	if err != nil || !strings.HasPrefix(string(data), "{") {
+		t.Fatalf("not saved in the new format: %s, %v", data, err)
+	}
+	cookies := mwlib.ReadCookies(cookieFile)
+	if len(cookies) != 1 || cookies[0].Value == "stale" || cookies[0].Path != "/" || !cookies[0].HttpOnly {
+		t.Errorf("got cookies %+v", cookies)
+	}
+}
+
+func TestReloginOnExpiredSession(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	state := newTestState(t, wiki)
+	wiki.expireSessions()
+	runCommand([]string{"File:A.jpg"}, state)
+	checkStats(t, state.stats, stats{withCamera: 1, edited: 1})
+	cookies, err := os.ReadFile(state.flags.CookieFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for session := range wiki.sessions {
+		if !strings.Contains(string(cookies), session) {
+			t.Errorf("new session not saved: %s", cookies)
+		}
+	}
+}
+
+func TestLoginAssertFails(t *testing.T) {
+	wiki := newFakeWiki(t)
+	state := newTestState(t, wiki)
+	state.flags.Assert = "bot"
+	if login(state) {
+		t.Error("login succeeded for a bot assertion on a user account")
+	}
+}
+
+func TestReloginAssertFails(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	state := newTestState(t, wiki)
+	state.flags.Assert = "bot"
+	state.editor.assert = "bot"
+	runCommand([]string{"User:Alice"}, state)
+
+	// Logging in again is tried once, and then edits stop.
+	if got := wiki.editedTitles(); len(got) != 0 {
+		t.Errorf("got edits %v", got)
+	}
+	if len(wiki.sessions) != 2 {
+		t.Errorf("got %d sessions, want 2", len(wiki.sessions))
+	}
+	if !state.editor.stopped() {
+		t.Error("edits not stopped")
+	}
+}
+
+func TestProcessOneFile(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	state := newTestState(t, wiki)
+	runCommand([]string{"File:A.jpg"}, state)
+	checkText(t, wiki, "File:A.jpg", "A cat.\n[[Category:Cats]]\n[[Category:Taken with Canon EOS 5D]]\n<!-- [[Category:Dogs]] -->")
+	checkStats(t, state.stats, stats{withCamera: 1, edited: 1})
+}
+
+func TestProcessOneFileMissing(t *testing.T) {
+	wiki := newFakeWiki(t)
+	state := newTestState(t, wiki)
+	runCommand([]string{"File:Nothing.jpg"}, state)
+	if wiki.editCount() != 0 {
+		t.Errorf("unexpected edits: %v", wiki.editedTitles())
+	}
+}
+
+func TestProcessUser(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	state := newTestState(t, wiki)
+	runCommand([]string{"User:Alice"}, state)
+	checkText(t, wiki, "File:A.jpg", "A cat.\n[[Category:Cats]]\n[[Category:Taken with Canon EOS 5D]]\n<!-- [[Category:Dogs]] -->")
+	checkText(t, wiki, "File:B.jpg", "[[Category:Taken with Canon EOS 5D]]")
+	checkText(t, wiki, "File:D.jpg", "Unmapped.")
+	checkText(t, wiki, "File:E.jpg", "Mapped by regex to a missing category.")
+	checkStats(t, state.stats, stats{examined: 5, withCamera: 4, warnings: 2, inCat: 1, edited: 1})
+}
+
+func TestProcessUserTimestamp(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	state := newTestState(t, wiki, "--back")
+	runCommand([]string{"User:Alice", "20190102000000"}, state)
+	checkText(t, wiki, "File:A.jpg", "A cat.\n[[Category:Cats]]\n[[Category:Taken with Canon EOS 5D]]\n<!-- [[Category:Dogs]] -->")
+	checkStats(t, state.stats, stats{examined: 2, withCamera: 2, inCat: 1, edited: 1})
+}
+
+func TestProcessCategory(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	state := newTestState(t, wiki)
+	runCommand([]string{"Category:Cats"}, state)
+	checkText(t, wiki, "File:F.jpg", "[[Category:Cats]]\n[[Category:Taken with Nikon D90]]")
+	// Adding to an empty category is a warning.
+	checkStats(t, state.stats, stats{examined: 2, withCamera: 2, warnings: 1, edited: 2})
+	if got := strings.Join(wiki.editedTitles(), ","); got != "File:A.jpg,File:F.jpg" {
+		t.Errorf("edited %s", got)
+	}
+}
+
+func TestProcessPage(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	wiki.addPage("Gallery", "<gallery>\nFile:F.jpg|A Nikon\nFile:C.jpg\n</gallery>\n[[File:B.jpg]]")
+	state := newTestState(t, wiki)
+	runCommand([]string{"Page:Gallery"}, state)
+	checkStats(t, state.stats, stats{examined: 3, withCamera: 2, warnings: 1, inCat: 1, edited: 1})
+}
+
+func TestProcessAll(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	state := newTestState(t, wiki, "--filelimit", "3")
+	runCommand([]string{"All", "20190104000000"}, state)
+	checkStats(t, state.stats, stats{examined: 3, withCamera: 3, warnings: 3, edited: 1})
+	if got := strings.Join(wiki.editedTitles(), ","); got != "File:F.jpg" {
+		t.Errorf("edited %s", got)
+	}
+}
+
+func TestProcessAllNeedsTimestamp(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	state := newTestState(t, wiki)
+	runCommand([]string{"All"}, state)
+	if wiki.editCount() != 0 {
+		t.Errorf("unexpected edits: %v", wiki.editedTitles())
+	}
+}
+
+func TestProcessRandom(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	state := newTestState(t, wiki, "--maxedits", "1")
+	runCommand([]string{"Random"}, state)
+	if wiki.editCount() != 1 {
+		t.Errorf("got %d edits, want 1", wiki.editCount())
+	}
+}
+
+func TestCatFileLimit(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	state := newTestState(t, wiki, "--catfilelimit", "2")
+	runCommand([]string{"User:Alice"}, state)
+	checkText(t, wiki, "File:A.jpg", "A cat.\n[[Category:Cats]]\n<!-- [[Category:Dogs]] -->")
+	// B.jpg is also skipped before its current categories are checked.
+	checkStats(t, state.stats, stats{examined: 5, withCamera: 4, warnings: 2, populated: 2})
+}
+
+func TestRemove(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	state := newTestState(t, wiki, "--remove", "Cats")
+	runCommand([]string{"File:F.jpg"}, state)
+	checkText(t, wiki, "File:F.jpg", "\n[[Category:Taken with Nikon D90]]")
+	if summary := wiki.edits[0].summary; summary != "moved from [[Category:Cats]] to [[Category:Taken with Nikon D90]]" {
+		t.Errorf("summary %q", summary)
+	}
+}
+
+func TestWarningLimit(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	state := newTestState(t, wiki, "--warninglimit", "1", "--batchsize", "1")
+	runCommand([]string{"User:Alice", "20190103000000"}, state)
+	// Files the lookups ran ahead to aren't counted.
+	checkStats(t, state.stats, stats{examined: 2, withCamera: 1, warnings: 1})
+}
+
+func TestWarningGallery(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	wiki.addPage("User:Bot/Warnings", "old")
+	state := newTestState(t, wiki, "--gallery", "User:Bot/Warnings")
+	runCommand([]string{"User:Alice"}, state)
+	checkText(t, wiki, "User:Bot/Warnings", "<gallery>\nFile:E.jpg|Category:Taken with Foo cameras doesn't exist\nFile:D.jpg|Unknown Thing\n</gallery>")
+}
+
+func TestLocalMappingFile(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	wiki.addPage("Category:Taken with Canon 5D", "")
+	local := writeTestFile(t, t.TempDir(), "local", "Canon,Canon EOS 5D,Canon 5D\n")
+	state := newTestState(t, wiki, "--localmappingfile", local)
+	runCommand([]string{"File:A.jpg"}, state)
+	checkText(t, wiki, "File:A.jpg", "A cat.\n[[Category:Cats]]\n[[Category:Taken with Canon 5D]]\n<!-- [[Category:Dogs]] -->")
+}
+
+// Load mappings for a test site from the given flags.
+func loadTestMappings(t testing.TB, flags flags) *mappingFiles {
+	t.Helper()
+	site := &site{categoryPrefix: "Category:", targetPrefix: "Taken with "}
+	mappings, err := newMappingFiles(flags, site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mappings
+}
+
+func TestEmbeddedMapping(t *testing.T) {
+	files, err := mappingSources(nil, "", "catmapping", defaultMapping)
+	if err != nil || len(files) != 1 || !files[0].embedded {
+		t.Fatalf("got sources %+v, %v", files, err)
+	}
+	mappings := loadTestMappings(t, flags{})
+	if len(mappings.get().categoryMap) == 0 || len(mappings.get().catRegex) == 0 {
+		t.Error("embedded mapping files are empty")
+	}
+}
+
+func TestMappingDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "1-shared", "Canon,Canon EOS 5D,Canon EOS 5D\nAcme,Widget,Widgets\n")
+	writeTestFile(t, dir, "2-local", "Canon,Canon EOS 5D,Canon 5D\n")
+	writeTestFile(t, dir, "2-local~", "Acme,Widget,Gadgets\n")
+	first := writeTestFile(t, t.TempDir(), "first", "Acme,Widget,Gizmos\n")
+	categories := loadTestMappings(t, flags{MappingFile: []string{first, dir}}).get().categoryMap
+	want := map[string]string{
+		"CanonCanon EOS 5D": "Category:Taken with Canon 5D",
+		"AcmeWidget":        "Category:Taken with Widgets",
+	}
+	for key, target := range want {
+		if categories[key] != target {
+			t.Errorf("%s: got %q, want %q", key, categories[key], target)
+		}
+	}
+}
+
+func TestRegexOverride(t *testing.T) {
+	dir := t.TempDir()
+	shared := writeTestFile(t, dir, "shared", "Foo.*,Foo cameras\nBar.*,Bar cameras\n")
+	local := writeTestFile(t, dir, "local", "Bar.*,Bar things\nBaz.*,Baz cameras\n")
+	regexes := loadTestMappings(t, flags{RegexFile: []string{shared, local}}).get().catRegex
+	var got []string
+	for _, r := range regexes {
+		got = append(got, r.regex.String()+"="+r.target)
+	}
+	want := "Bar.*=Category:Taken with Bar things,Baz.*=Category:Taken with Baz cameras,Foo.*=Category:Taken with Foo cameras"
+	if strings.Join(got, ",") != want {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestReloadMappings(t *testing.T) {
+	dir := t.TempDir()
+	file := writeTestFile(t, dir, "catmapping", "Canon,Canon EOS 5D,Canon EOS 5D\n")
+	mappings := loadTestMappings(t, flags{MappingFile: []string{dir}})
+	old := mappings.get()
+	mappings.reload()
+	if mappings.get() != old {
+		t.Error("reloaded unchanged files")
+	}
+	// A bad file is reported and the old mappings kept.
+	writeTestFile(t, dir, "local", "Canon,Canon EOS 6D\n")
+	mappings.reload()
+	if mappings.get() != old {
+		t.Error("replaced mappings with a bad file")
+	}
+	writeTestFile(t, dir, "local", "Canon,Canon EOS 6D,Canon EOS 6D\n")
+	if err := os.WriteFile(file, []byte("Canon,Canon EOS 5D,Canon 5D\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mappings.reload()
+	categories := mappings.get().categoryMap
+	if categories["CanonCanon EOS 5D"] != "Category:Taken with Canon 5D" || categories["CanonCanon EOS 6D"] != "Category:Taken with Canon EOS 6D" {
+		t.Errorf("got %v", categories)
+	}
+}
+
+func TestManyTitles(t *testing.T) {
+	for _, bot := range []bool{false, true} {
+		wiki := newFakeWiki(t)
+		wiki.bot = bot
+		wiki.addPage("Category:Taken with Canon EOS 5D", "")
+		for i := 0; i < 120; i++ {
+			wiki.addFile("File:Many "+strconv.Itoa(i)+".jpg", "Dave", "20200101000000", "Canon", "Canon EOS 5D", "[[Category:Taken with Canon EOS 5D]]")
+		}
+		state := newTestState(t, wiki, "--batchsize", "120", "--catfilelimit", "0")
+		runCommand([]string{"User:Dave"}, state)
+		checkStats(t, state.stats, stats{examined: 120, withCamera: 120, inCat: 120})
+		want := 3
+		if bot {
+			want = 1
+		}
+		if got := wiki.props["categories"]; got != want {
+			t.Errorf("bot %v: got %d categories queries, want %d", bot, got, want)
+		}
+	}
+}
+
+func TestCategoryContinuation(t *testing.T) {
+	wiki := newFakeWiki(t)
+	wiki.catLimit = 2
+	wiki.addPage("Category:Taken with Canon EOS 5D", "")
+	wiki.addFile("File:X.jpg", "Erin", "20200101000000", "Canon", "Canon EOS 5D", "[[Category:Cats]] [[Category:Dogs]] [[Category:Taken with Canon EOS 5D]]")
+	wiki.addFile("File:Y.jpg", "Erin", "20200102000000", "Canon", "Canon EOS 5D", "[[Category:Cats]]")
+	wiki.addFile("File:Z.jpg", "Erin", "20200103000000", "Canon", "Canon EOS 5D", "[[Category:Birds]] [[Category:Fish]] [[Category:Taken with Canon EOS 5D]]")
+
+	cats := getPageCategories([]string{"File:X.jpg", "File:Y.jpg", "File:Z.jpg", "File:Missing.jpg"}, newTestState(t, wiki).client, 50)
+	want := map[string]string{
+		"File:X.jpg":       "Category:Cats|Category:Dogs|Category:Taken with Canon EOS 5D",
+		"File:Y.jpg":       "Category:Cats",
+		"File:Z.jpg":       "Category:Birds|Category:Fish|Category:Taken with Canon EOS 5D",
+		"File:Missing.jpg": "",
+	}
+	if len(cats) != len(want) {
+		t.Errorf("got %v", cats)
+	}
+	for title, list := range want {
+		if got := strings.Join(cats[title], "|"); got != list {
+			t.Errorf("%s: got %q, want %q", title, got, list)
+		}
+	}
+	if wiki.props["categories"] != 4 {
+		t.Errorf("got %d categories queries, want 4", wiki.props["categories"])
+	}
+
+	// Only Y.jpg needs the category, and no file gets it twice.
+	state := newTestState(t, wiki, "--catfilelimit", "0")
+	runCommand([]string{"User:Erin"}, state)
+	checkStats(t, state.stats, stats{examined: 3, withCamera: 3, inCat: 2, edited: 1})
+	checkText(t, wiki, "File:X.jpg", "[[Category:Cats]] [[Category:Dogs]] [[Category:Taken with Canon EOS 5D]]")
+}
+
+func TestNormalisedTitles(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	wiki.addPage("File:Old name.jpg", "#REDIRECT [[File:F.jpg]]")
+	client := newTestState(t, wiki).client
+	cats := getPageCategories([]string{"File:f.jpg", "File:Old_name.jpg", "File:F.jpg", "File:B.jpg"}, client, 50)
+	want := map[string]string{
+		"File:f.jpg":        "Category:Cats",
+		"File:Old_name.jpg": "Category:Cats",
+		"File:F.jpg":        "Category:Cats",
+		"File:B.jpg":        "Category:Taken with Canon EOS 5D",
+	}
+	for title, list := range want {
+		if got := strings.Join(cats[title], "|"); got != list {
+			t.Errorf("%s: got %q, want %q", title, got, list)
+		}
+	}
+	names, counts := catNumFiles([]string{"Category:Taken_with Canon EOS 5D", "Category:taken with Nikon D90", "Category:Nothing"}, client, 50)
+	got := make(map[string]int32)
+	for i := range names {
+		got[names[i]] = counts[i]
+	}
+	wantCounts := map[string]int32{"Category:Taken_with Canon EOS 5D": 3, "Category:taken with Nikon D90": 0}
+	if len(got) != len(wantCounts) {
+		t.Errorf("got %v", got)
+	}
+	for name, count := range wantCounts {
+		if c, found := got[name]; !found || c != count {
+			t.Errorf("%s: got %d, %v", name, c, found)
+		}
+	}
+}
+
+func TestProcessSearch(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	state := newTestState(t, wiki, "--batchsize", "1")
+	runCommand([]string{"Search:canon -dogs"}, state)
+	// B.jpg is already categorised, the existing files have no Exif and
+	// A.jpg mentions dogs.
+	checkStats(t, state.stats, stats{examined: 3, withCamera: 1, inCat: 1})
+	checkText(t, wiki, "File:A.jpg", "A cat.\n[[Category:Cats]]\n<!-- [[Category:Dogs]] -->")
+	if wiki.props["imageinfo"] != 3 {
+		t.Errorf("got %d imageinfo queries, want 3", wiki.props["imageinfo"])
+	}
+}
+
+func TestSearchDefaultBatchSize(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	// The default batch size is over the search limit for users without
+	// apihighlimits.
+	state := newTestState(t, wiki, "--batchsize", "100")
+	runCommand([]string{"Search:canon"}, state)
+	checkStats(t, state.stats, stats{examined: 4, withCamera: 2, inCat: 1, edited: 1})
+}
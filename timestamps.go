@@ -1,8 +1,14 @@
 package main
 
 import (
+	"cgt.name/pkg/go-mwclient/params"
 	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // A timestamp is either a string representation of a date/time or
@@ -12,21 +18,169 @@ type timestamp struct {
 	valid  bool
 }
 
+// Format of timestamps given to the API.
+const apiTimeFormat = "20060102150405"
+
+// Layouts of absolute times accepted as input. Times without a zone are UTC.
+var timeLayouts = []string{
+	apiTimeFormat,
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// Relative times, such as 7d for seven days ago. A leading "-" is also
+// accepted, but on the command line it's only seen as part of the
+// timestamp after "--", since otherwise it's taken for an option.
+var relativeTime = regexp.MustCompile(`^-?(\d+)([smhdw])$`)
+
+var timeUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
 func newTimestampEmpty() timestamp {
 	return timestamp{"", false}
 }
 
 func newTimestamp(input string) (timestamp, error) {
-	makeErr := func() error {
-		return errors.New("Invalid timestamp. Format must be YYYYMMDDHHMMSS.")
+	return parseTimestamp(input, time.Now())
+}
+
+// Parse a timestamp given as YYYYMMDDHHMMSS, in ISO 8601 format, as a date,
+// or relative to now, e.g., "7d", "today" or "yesterday". Dates are
+// taken as midnight UTC.
+func parseTimestamp(input string, now time.Time) (timestamp, error) {
+	input = strings.TrimSpace(input)
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch strings.ToLower(input) {
+	case "now":
+		return timeTimestamp(now), nil
+	case "today":
+		return timeTimestamp(midnight), nil
+	case "yesterday":
+		return timeTimestamp(midnight.AddDate(0, 0, -1)), nil
+	}
+	if match := relativeTime.FindStringSubmatch(input); match != nil {
+		count, err := strconv.Atoi(match[1])
+		if err != nil {
+			return newTimestampEmpty(), fmt.Errorf("Invalid timestamp %q: %v", input, err)
+		}
+		return timeTimestamp(now.Add(-time.Duration(count) * timeUnits[match[2]])), nil
 	}
-	// Basic checks, the MediaWiki API will reject invalid values anyway.
-	if len(input) != 14 {
-		return newTimestampEmpty(), makeErr()
+	for _, layout := range timeLayouts {
+		t, err := time.ParseInLocation(layout, input, time.UTC)
+		if err == nil {
+			return timeTimestamp(t), nil
+		}
+		// Report a bad value in the expected format, e.g., month 13.
+		if len(input) == len(layout) && !strings.Contains(err.Error(), "cannot parse") {
+			return newTimestampEmpty(), fmt.Errorf("Invalid timestamp %q: %v", input, err)
+		}
+	}
+	return newTimestampEmpty(), fmt.Errorf("Invalid timestamp %q. Use YYYYMMDDHHMMSS, an ISO 8601 time such as 2019-05-01T12:00:00Z, a date such as 2019-05-01, a time ago such as 7d or 12h, today or yesterday, or a file title or URL for its upload time.", input)
+}
+
+func timeTimestamp(t time.Time) timestamp {
+	return timestamp{t.UTC().Format(apiTimeFormat), true}
+}
+
+// Parse a timestamp given on the command line, which may also be a file
+// title or URL meaning the time the file was uploaded.
+func commandTimestamp(input string, state *state) (timestamp, error) {
+	title, found := fileReference(input, state.site)
+	if !found {
+		return newTimestamp(input)
+	}
+	return uploadTime(title, state.client)
+}
+
+// Return the file title given as a title or a URL of its description page
+// or the file itself, and whether the input was one of those.
+func fileReference(input string, site *site) (string, bool) {
+	var title string
+	if strings.HasPrefix(input, "http://") || strings.HasPrefix(input, "https://") {
+		u, err := url.Parse(input)
+		if err != nil {
+			return "", false
+		}
+		segments := strings.Split(u.Path, "/")
+		if u.Query().Get("title") != "" {
+			title = u.Query().Get("title")
+		} else if strings.HasPrefix(u.Path, "/wiki/") {
+			title = strings.TrimPrefix(u.Path, "/wiki/")
+		} else if strings.HasPrefix(u.Host, "upload.") && len(segments) > 1 {
+			// E.g., /wikipedia/commons/a/ab/Name.jpg, or for thumbnails,
+			// /wikipedia/commons/thumb/a/ab/Name.jpg/220px-Name.jpg.
+			title = segments[len(segments)-1]
+			for i := range segments {
+				if segments[i] == "thumb" && i+3 < len(segments) {
+					title = segments[i+3]
+					break
+				}
+			}
+			title = site.filePrefixes[0] + title
+		}
+		title = strings.Replace(title, "_", " ", -1)
+	} else {
+		title = input
 	}
-	_, err := strconv.Atoi(input)
+	if !site.isFile(title) {
+		return "", false
+	}
+	return title, true
+}
+
+// Return the time a file was last uploaded.
+func uploadTime(title string, client wiki) (timestamp, error) {
+	params := params.Values{
+		"action":    "query",
+		"titles":    title,
+		"prop":      "imageinfo",
+		"iiprop":    "timestamp",
+		"redirects": "",
+	}
+	json, err := client.Get(params)
+	if err != nil {
+		return newTimestampEmpty(), err
+	}
+	pages, err := json.GetObjectArray("query", "pages")
+	if err != nil {
+		return newTimestampEmpty(), err
+	}
+	if missing, err := pages[0].GetBoolean("missing"); err == nil && missing {
+		return newTimestampEmpty(), errors.New(title + " does not exist.")
+	}
+	imageinfo, err := pages[0].GetObjectArray("imageinfo")
+	if err != nil || len(imageinfo) == 0 {
+		return newTimestampEmpty(), errors.New(title + " has no upload information.")
+	}
+	uploaded, err := imageinfo[0].GetString("timestamp")
+	if err != nil {
+		return newTimestampEmpty(), err
+	}
+	t, err := time.Parse(time.RFC3339, uploaded)
 	if err != nil {
-		return newTimestampEmpty(), makeErr()
+		return newTimestampEmpty(), err
+	}
+	return timeTimestamp(t), nil
+}
+
+// Return an error if end comes before start in the direction of
+// processing, i.e., after it when going back in time.
+func checkRange(start, end timestamp, back bool) error {
+	if back && end.string > start.string {
+		return errors.New("The end timestamp must not be after the start timestamp when going back in time.")
+	}
+	if !back && end.string < start.string {
+		return errors.New("The end timestamp must not be before the start timestamp.")
 	}
-	return timestamp{input, true}, nil
+	return nil
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	now := time.Date(2019, 5, 10, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		input string
+		want  string // Blank for an error.
+	}{
+		{"20190501000000", "20190501000000"},
+		{"2019-05-01T12:00:00Z", "20190501120000"},
+		{"2019-05-01T12:00:00+02:00", "20190501100000"},
+		{"2019-05-01T12:00:00", "20190501120000"},
+		{"2019-05-01 12:00:00", "20190501120000"},
+		{"2019-05-01T12:00", "20190501120000"},
+		{"2019-05-01", "20190501000000"},
+		{"7d", "20190503123000"},
+		{"-7d", "20190503123000"},
+		{"-2h", "20190510103000"},
+		{"-1w", "20190503123000"},
+		{"now", "20190510123000"},
+		{"Today", "20190510000000"},
+		{"yesterday", "20190509000000"},
+		{"20191301000000", ""},
+		{"2019-02-30", ""},
+		{"2019050100000", ""},
+		{"7", ""},
+		{"7y", ""},
+		{"+7d", ""},
+		{"last week", ""},
+	}
+	for _, test := range tests {
+		got, err := parseTimestamp(test.input, now)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q: got %q, want an error", test.input, got.string)
+			}
+		} else if err != nil || !got.valid || got.string != test.want {
+			t.Errorf("%q: got %q, %v, want %q", test.input, got.string, err, test.want)
+		}
+	}
+}
+
+func TestRelativeTimeArgument(t *testing.T) {
+	// The arguments are parsed as they are from the command line, where a
+	// relative time with a leading "-" is taken for an option unless it
+	// comes after "--".
+	tests := []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"--operator", "test", "All", "7d"}, true},
+		{[]string{"--operator", "test", "--", "All", "-7d"}, true},
+		{[]string{"--operator", "test", "All", "-7d"}, false},
+	}
+	for _, test := range tests {
+		args, _, err := parseArgs(test.args)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%q: got arguments %q, want an error", test.args, args)
+			}
+			continue
+		}
+		if err != nil || len(args) != 2 || args[0] != "All" {
+			t.Errorf("%q: got %q, %v", test.args, args, err)
+			continue
+		}
+		if got, err := newTimestamp(args[1]); err != nil || !got.valid {
+			t.Errorf("%q: got %q, %v", test.args, got.string, err)
+		}
+	}
+}
+
+func TestFileReference(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string // Blank if not a file reference.
+	}{
+		{"File:C.jpg", "File:C.jpg"},
+		{"Image:C.jpg", "Image:C.jpg"},
+		{"https://commons.wikimedia.org/wiki/File:C_d.jpg", "File:C d.jpg"},
+		{"https://commons.wikimedia.org/w/index.php?title=File:C.jpg&action=history", "File:C.jpg"},
+		{"https://upload.wikimedia.org/wikipedia/commons/a/ab/C.jpg", "File:C.jpg"},
+		{"https://upload.wikimedia.org/wikipedia/commons/thumb/a/ab/C.jpg/220px-C.jpg", "File:C.jpg"},
+		{"https://commons.wikimedia.org/wiki/Main_Page", ""},
+		{"20190501000000", ""},
+	}
+	for _, test := range tests {
+		got, found := fileReference(test.input, testSite)
+		if got != test.want || found != (test.want != "") {
+			t.Errorf("%s: got %q, %v, want %q", test.input, got, found, test.want)
+		}
+	}
+}
+
+func TestFileTimestamp(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	tests := []struct {
+		input string
+		want  int32
+	}{
+		{"File:C.jpg", 4},
+		{"https://commons.wikimedia.org/wiki/File:C.jpg", 4},
+		{"https://upload.wikimedia.org/wikipedia/commons/thumb/a/ab/C.jpg/220px-C.jpg", 4},
+		{"File:Missing.jpg", 0},
+	}
+	for _, test := range tests {
+		state := runTestCommand(t, wiki, []string{"All", test.input}, "--catfilelimit", "0")
+		if got := state.stats.examined; got != test.want {
+			t.Errorf("%s: examined %d files, want %d", test.input, got, test.want)
+		}
+	}
+}
+
+func TestCheckRange(t *testing.T) {
+	early, late := timestamp{"20190102000000", true}, timestamp{"20190104000000", true}
+	tests := []struct {
+		start, end timestamp
+		back       bool
+		ok         bool
+	}{
+		{early, late, false, true},
+		{early, early, false, true},
+		{late, early, false, false},
+		{late, early, true, true},
+		{early, late, true, false},
+	}
+	for _, test := range tests {
+		if err := checkRange(test.start, test.end, test.back); (err == nil) != test.ok {
+			t.Errorf("%s to %s, back %v: got %v", test.start.string, test.end.string, test.back, err)
+		}
+	}
+}
+
+func TestEndTimestamp(t *testing.T) {
+	wiki := newFakeWiki(t)
+	addTestFiles(wiki)
+	tests := []struct {
+		args  []string
+		flags []string
+		want  int32
+	}{
+		{[]string{"All", "20190102000000", "20190104000000"}, nil, 3},
+		{[]string{"All", "20190104000000", "20190104000000"}, nil, 1},
+		{[]string{"User:Alice", "20190104000000", "20190102000000"}, []string{"--back"}, 3},
+		{[]string{"Category:Cats", "20190101000000", "20190102000000"}, nil, 1},
+		{[]string{"Category:Cats", "20190101000000", "20190102000000"}, []string{"--depth", "1"}, 1},
+		// The end can't be before the start.
+		{[]string{"All", "20190104000000", "20190102000000"}, nil, 0},
+		{[]string{"Recent", "20190104000000", "20190105000000"}, nil, 0},
+	}
+	for _, test := range tests {
+		state := runTestCommand(t, wiki, test.args, append(test.flags, "--catfilelimit", "0")...)
+		if got := state.stats.examined; got != test.want {
+			t.Errorf("%v %v: examined %d files, want %d", test.args, test.flags, got, test.want)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	mwclient "cgt.name/pkg/go-mwclient"
 	"fmt"
 	"sort"
 	"strings"
@@ -40,7 +39,7 @@ func (warnings *warnings) Append(files []fileData) {
 
 // Create a gallery showing all the files with warnings. Page must already
 // exist and will be replaced.
-func (warnings warnings) createGallery(gallery string, client *mwclient.Client) {
+func (warnings warnings) createGallery(gallery string, client wiki, editor *editor) {
 	var saveError error
 	sort.Sort(warnings)
 	for i := 0; i < 3; i++ {
@@ -77,13 +76,17 @@ func (warnings warnings) createGallery(gallery string, client *mwclient.Client)
 			"bot":           "",
 			"basetimestamp": timestamp,
 		}
-		saveError = client.Edit(editcfg)
+		saveError = editor.edit(editcfg, false)
 		if saveError != nil && strings.Contains(saveError.Error(), "edit successful, but did not change page") {
 			saveError = nil
 		}
 		if saveError == nil {
 			break
 		}
+		if saveError == errNoSession {
+			warn.Print("Can't save ", gallery, ": ", saveError)
+			return
+		}
 	}
 	if saveError != nil {
 		panic(fmt.Sprintf("Failed to save %v %v", gallery, saveError))
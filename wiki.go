@@ -0,0 +1,316 @@
+package main
+
+import (
+	"cgt.name/pkg/go-mwclient/params"
+	"fmt"
+	"github.com/antonholmquist/jason"
+	"github.com/garyhouston/takenwith/mwlib"
+	"net/http"
+	"sync"
+)
+
+// The operations that the bot uses on the Wiki. It's implemented by
+// *mwclient.Client, and by recorder and replayer for reproducing runs
+// offline.
+type wiki interface {
+	// Make a GET or POST request to the API, returning API errors
+	// and warnings as the error.
+	Get(params params.Values) (*jason.Object, error)
+	Post(params params.Values) (*jason.Object, error)
+	// Return the text and timestamp of the latest revision of a page.
+	GetPageByName(title string) (string, string, error)
+	// Make an edit. Returns mwclient.ErrEditNoChange if the text was
+	// unchanged.
+	Edit(params params.Values) error
+	Login(username, password string) error
+	DumpCookies() []*http.Cookie
+	LoadCookies(cookies []*http.Cookie)
+}
+
+// Results of a query, fetched one response at a time.
+type results interface {
+	// Fetch the next response, returning false when there are no more
+	// or on error.
+	Next() bool
+	// Return the last response fetched.
+	Resp() *jason.Object
+	Err() error
+}
+
+// A query that follows continuations, like mwclient.Query but for any wiki.
+type query struct {
+	client wiki
+	params params.Values
+	post   bool
+	resp   *jason.Object
+	err    error
+}
+
+func newQuery(client wiki, params params.Values) *query {
+	params["action"] = "query"
+	params["continue"] = ""
+	return &query{client: client, params: params}
+}
+
+// Return a query made with POST requests, for long parameters such as
+// lists of titles.
+func newPostQuery(client wiki, params params.Values) *query {
+	q := newQuery(client, params)
+	q.post = true
+	return q
+}
+
+// Fetch the next set of results, returning false when there are no more
+// or on error.
+func (q *query) Next() bool {
+	if q.resp != nil {
+		cont, err := q.resp.GetObject("continue")
+		if err != nil {
+			return false
+		}
+		for key, value := range cont.Map() {
+			str, err := value.String()
+			if err != nil {
+				q.err = fmt.Errorf("response processing error: %v", err)
+				return false
+			}
+			q.params[key] = str
+		}
+	}
+	if q.post {
+		q.resp, q.err = q.client.Post(q.params)
+	} else {
+		q.resp, q.err = q.client.Get(q.params)
+	}
+	return q.err == nil
+}
+
+// Return the result of the last call to Next.
+func (q *query) Resp() *jason.Object {
+	return q.resp
+}
+
+// Return the error from the last call to Next, if any.
+func (q *query) Err() error {
+	return q.err
+}
+
+// Return the number of titles that may be given in one query: 500 if the
+// account has the apihighlimits right, as bots do, otherwise 50.
+func titleLimit(client wiki) int {
+	params := params.Values{
+		"action": "query",
+		"meta":   "userinfo",
+		"uiprop": "rights",
+	}
+	json, err := client.Get(params)
+	if err != nil {
+		panic(err)
+	}
+	rights, err := json.GetStringArray("query", "userinfo", "rights")
+	if err != nil {
+		panic(err)
+	}
+	for _, right := range rights {
+		if right == "apihighlimits" {
+			return 500
+		}
+	}
+	return 50
+}
+
+// Return a map from the titles of the pages in a query response to the
+// titles requested for them, which differ if the Wiki normalised a title or
+// followed a redirect.
+func requestedTitles(resp *jason.Object, requested []string) map[string][]string {
+	normalized := titleChanges(resp, "normalized")
+	redirects := titleChanges(resp, "redirects")
+	result := make(map[string][]string)
+	for _, title := range requested {
+		returned := title
+		if to, found := normalized[returned]; found {
+			returned = to
+		}
+		if to, found := redirects[returned]; found {
+			returned = to
+		}
+		result[returned] = append(result[returned], title)
+	}
+	return result
+}
+
+// Return the from -> to title changes listed in a query response under
+// key, e.g., "normalized".
+func titleChanges(resp *jason.Object, key string) map[string]string {
+	changes := make(map[string]string)
+	list, err := resp.GetObjectArray("query", key)
+	if err != nil {
+		return changes
+	}
+	for _, change := range list {
+		from, err := change.GetString("from")
+		if err != nil {
+			panic(err)
+		}
+		to, err := change.GetString("to")
+		if err != nil {
+			panic(err)
+		}
+		changes[from] = to
+	}
+	return changes
+}
+
+// A query over a list of titles, made in chunks of at most limit titles,
+// each of which follows continuations.
+type titlesQuery struct {
+	client  wiki
+	params  params.Values
+	titles  []string
+	limit   int
+	current *query
+	err     error
+}
+
+func newTitlesQuery(client wiki, params params.Values, titles []string, limit int) *titlesQuery {
+	return &titlesQuery{client: client, params: params, titles: titles, limit: limit}
+}
+
+func (q *titlesQuery) Next() bool {
+	for {
+		if q.current != nil {
+			if q.current.Next() {
+				return true
+			}
+			if q.err = q.current.Err(); q.err != nil {
+				return false
+			}
+		}
+		if len(q.titles) == 0 {
+			return false
+		}
+		chunk := q.titles
+		if len(chunk) > q.limit {
+			chunk = chunk[:q.limit]
+		}
+		q.titles = q.titles[len(chunk):]
+		params := make(params.Values, len(q.params)+1)
+		for key, value := range q.params {
+			params[key] = value
+		}
+		params["titles"] = mwlib.MakeTitleString(chunk)
+		// Post, since Get may fail on long queries.
+		q.current = newPostQuery(q.client, params)
+	}
+}
+
+func (q *titlesQuery) Resp() *jason.Object {
+	return q.current.Resp()
+}
+
+func (q *titlesQuery) Err() error {
+	return q.err
+}
+
+// Return true if the query has more results to fetch.
+func (q *query) more() bool {
+	if q.resp == nil {
+		return true
+	}
+	_, err := q.resp.GetObject("continue")
+	return err == nil
+}
+
+// Return true if the query has more results to fetch.
+func (q *titlesQuery) more() bool {
+	return len(q.titles) > 0 || q.current == nil || q.current.more()
+}
+
+// Results that may block waiting for more, e.g., for new uploads. Stop
+// makes Next return false instead of waiting.
+type stoppable interface {
+	Stop()
+}
+
+// Results with actions to take once the files they returned have been
+// processed, e.g., saving the position reached in the upload log.
+type checkpointer interface {
+	// Return the actions to take once the files from the last response,
+	// and all before it, are processed, and forget them.
+	checkpoints() []func()
+}
+
+// Produces titles to process, e.g., from the upload log, blocking until
+// there are some. done, if not nil, is called once their files have all
+// been processed. more is false if there are no more titles or stop has
+// been closed.
+type titleSource func(stop <-chan struct{}) (titles []string, done func(), more bool)
+
+// A query over the titles from a source, as they are produced.
+type sourceQuery struct {
+	client   wiki
+	params   params.Values
+	limit    int
+	source   titleSource
+	current  *titlesQuery
+	done     func()   // Action for the titles of current.
+	pending  []func() // Actions for earlier titles, not yet taken.
+	stop     chan struct{}
+	stopOnce sync.Once
+	err      error
+}
+
+func newSourceQuery(client wiki, params params.Values, source titleSource, limit int) *sourceQuery {
+	return &sourceQuery{client: client, params: params, source: source, limit: limit, stop: make(chan struct{})}
+}
+
+func (q *sourceQuery) Next() bool {
+	for {
+		if q.current != nil {
+			if q.current.Next() {
+				return true
+			}
+			if q.err = q.current.Err(); q.err != nil {
+				return false
+			}
+			// Only possible if there were no titles.
+			if q.done != nil {
+				q.pending = append(q.pending, q.done)
+			}
+			q.current = nil
+		}
+		titles, done, more := q.source(q.stop)
+		if !more {
+			return false
+		}
+		q.current = newTitlesQuery(q.client, q.params, titles, q.limit)
+		q.done = done
+	}
+}
+
+func (q *sourceQuery) Resp() *jason.Object {
+	return q.current.Resp()
+}
+
+func (q *sourceQuery) Err() error {
+	return q.err
+}
+
+func (q *sourceQuery) Stop() {
+	q.stopOnce.Do(func() {
+		close(q.stop)
+	})
+}
+
+func (q *sourceQuery) checkpoints() []func() {
+	if q.current != nil && q.current.more() {
+		return nil
+	}
+	result := q.pending
+	if q.current != nil && q.done != nil {
+		result = append(result, q.done)
+		q.done = nil
+	}
+	q.pending = nil
+	return result
+}